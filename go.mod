@@ -1 +1,3 @@
 module github.com/mhilton/openid
+
+go 1.27.1
@@ -1,15 +1,20 @@
 package openid2
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
-	"encoding/ascii85"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -37,22 +42,92 @@ type Association struct {
 
 	// Expires holds the expiration time of the association.
 	Expires time.Time
+
+	// Signer, if set, is used to compute signatures with this
+	// association. If Signer is nil an HMAC keyed with Secret is
+	// computed in process.
+	Signer Signer
+}
+
+// associationLifetime is the time for which the associations the
+// handler creates to sign assertions are valid.
+const associationLifetime = time.Minute
+
+// validityGrace is the period after an association's expiry time
+// during which it is still considered valid, to allow for small
+// differences between clocks.
+const validityGrace = time.Second
+
+// Valid reports whether the association is valid at the given time.
+func (a Association) Valid(now time.Time) bool {
+	return now.Before(a.Expires.Add(validityGrace))
+}
+
+// sign computes the signature of the signed fields in params. If length
+// is positive the signature is truncated to at most length bytes.
+func (a Association) sign(params map[string]string, signed []string, length int) (string, error) {
+	signer := a.Signer
+	if signer == nil {
+		signer = hmacSigner(a.Secret)
+	}
+	var base bytes.Buffer
+	for _, k := range signed {
+		WriteKeyValuePair(&base, k, params[k])
+	}
+	sig, err := signer.Sign(a.Type, base.Bytes())
+	if err != nil {
+		return "", err
+	}
+	if length > 0 && length < len(sig) {
+		sig = sig[:length]
+	}
+	return base64.URLEncoding.EncodeToString(sig), nil
 }
 
-func (a Association) sign(params map[string]string, signed []string) (string, error) {
+// VerifyAssertion reports whether the signature in the assertion
+// params, which must not include the "openid." prefix, is valid for
+// the association a. The signature is computed over the fields listed
+// in params["signed"] and compared in constant time. If length is
+// positive the signature is truncated to at most length bytes before
+// comparison, as for the Handler's SignatureLengths.
+func VerifyAssertion(a *Association, params map[string]string, length int) (bool, error) {
+	if params["signed"] == "" || params["sig"] == "" {
+		return false, nil
+	}
+	sig, err := a.sign(params, strings.Split(params["signed"], ","), length)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal([]byte(params["sig"]), []byte(sig)), nil
+}
+
+// Signer computes message signatures for an association. It allows
+// association secrets to be held outside of the process, for example
+// in an HSM or KMS.
+type Signer interface {
+	// Sign returns the signature of base, which is a key-value form
+	// encoded message, using the algorithm for the specified
+	// association type.
+	Sign(assocType string, base []byte) ([]byte, error)
+}
+
+// hmacSigner is a Signer that computes an HMAC in process using the
+// secret.
+type hmacSigner []byte
+
+// Sign implements Signer.Sign.
+func (s hmacSigner) Sign(assocType string, base []byte) ([]byte, error) {
 	var h hash.Hash
-	switch a.Type {
+	switch assocType {
 	case hmacSHA1:
-		h = hmac.New(sha1.New, a.Secret)
+		h = hmac.New(sha1.New, s)
 	case hmacSHA256:
-		h = hmac.New(sha256.New, a.Secret)
+		h = hmac.New(sha256.New, s)
 	default:
-		return "", fmt.Errorf("unsupported association type %q", a.Type)
-	}
-	for _, k := range signed {
-		WriteKeyValuePair(h, k, params[k])
+		return nil, fmt.Errorf("unsupported association type %q", assocType)
 	}
-	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+	h.Write(base)
+	return h.Sum(nil), nil
 }
 
 // AssociationStore is used to store associations in both the server and client.
@@ -67,10 +142,100 @@ type AssociationStore interface {
 	Get(endpoint, handle string) (*Association, error)
 
 	// Find retrieves all Associations for the specified endpoint.
+	// Associations that have expired but not yet been removed must
+	// also be returned, so that SweepAssociations can remove them.
 	Find(endpoint string) ([]*Association, error)
 
 	// Delete removes the Association with the specified endpoint and handle.
 	Delete(endpoint, handle string) error
+
+	// DeleteAll removes all Associations for the specified endpoint.
+	DeleteAll(endpoint string) error
+}
+
+// BatchDeleter is an optional interface that may be implemented by an
+// AssociationStore that can efficiently remove all expired
+// associations.
+type BatchDeleter interface {
+	// DeleteExpired removes all associations that are no longer
+	// valid at the given time, and returns the number removed.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// ContextAssociationStore is an optional interface that may be
+// implemented by an AssociationStore whose operations can be
+// cancelled. If the store implements it the Handler uses these methods,
+// passing the context of the request being served, in place of Add,
+// Get and Delete.
+type ContextAssociationStore interface {
+	AddContext(ctx context.Context, a *Association) error
+	GetContext(ctx context.Context, endpoint, handle string) (*Association, error)
+	DeleteContext(ctx context.Context, endpoint, handle string) error
+}
+
+// storeAdd adds a to store, using ctx if the store supports it. The
+// context's error is returned if it is done before the store is used.
+func storeAdd(ctx context.Context, store AssociationStore, a *Association) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cs, ok := store.(ContextAssociationStore); ok {
+		return cs.AddContext(ctx, a)
+	}
+	return store.Add(a)
+}
+
+// storeGet retrieves an association from store, using ctx if the store
+// supports it.
+func storeGet(ctx context.Context, store AssociationStore, endpoint, handle string) (*Association, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cs, ok := store.(ContextAssociationStore); ok {
+		return cs.GetContext(ctx, endpoint, handle)
+	}
+	return store.Get(endpoint, handle)
+}
+
+// storeDelete removes an association from store, using ctx if the
+// store supports it.
+func storeDelete(ctx context.Context, store AssociationStore, endpoint, handle string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cs, ok := store.(ContextAssociationStore); ok {
+		return cs.DeleteContext(ctx, endpoint, handle)
+	}
+	return store.Delete(endpoint, handle)
+}
+
+// SweepAssociations removes the associations in store that are no
+// longer valid at the given time, and returns the number removed. If
+// store implements BatchDeleter its DeleteExpired method is used,
+// otherwise the associations for each of the given endpoints are
+// found with Find, which returns expired associations, and deleted
+// individually.
+func SweepAssociations(store AssociationStore, now time.Time, endpoints ...string) (int, error) {
+	if bd, ok := store.(BatchDeleter); ok {
+		return bd.DeleteExpired(now)
+	}
+	var n int
+	for _, ep := range endpoints {
+		assocs, err := store.Find(ep)
+		if err != nil {
+			return n, err
+		}
+		for _, a := range assocs {
+			if a.Valid(now) {
+				continue
+			}
+			if err := store.Delete(a.Endpoint, a.Handle); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
 }
 
 // MemoryAssociationStore is an in memory implementation of AssociationStore.
@@ -105,6 +270,7 @@ func (s *MemoryAssociationStore) Add(a *Association) error {
 func (s *MemoryAssociationStore) Find(endpoint string) ([]*Association, error) {
 	var assocs []*Association
 	for _, a := range s.m[endpoint] {
+		a := a
 		assocs = append(assocs, &a)
 	}
 	return assocs, nil
@@ -116,7 +282,7 @@ func (s *MemoryAssociationStore) Get(endpoint, handle string) (*Association, err
 		return nil, nil
 	}
 	a, ok := s.m[endpoint][handle]
-	if !ok {
+	if !ok || !a.Valid(time.Now()) {
 		return nil, nil
 	}
 	return &a, nil
@@ -124,60 +290,181 @@ func (s *MemoryAssociationStore) Get(endpoint, handle string) (*Association, err
 
 // Delete implements AssociationStore.Delete.
 func (s *MemoryAssociationStore) Delete(endpoint, handle string) error {
-	a, err := s.Get(endpoint, handle)
-	if err != nil {
-		return err
-	}
-	if a == nil {
-		return nil
-	}
 	delete(s.m[endpoint], handle)
 	return nil
 }
 
+// DeleteAll implements AssociationStore.DeleteAll.
+func (s *MemoryAssociationStore) DeleteAll(endpoint string) error {
+	delete(s.m, endpoint)
+	return nil
+}
+
+// DeleteExpired implements BatchDeleter.DeleteExpired.
+func (s *MemoryAssociationStore) DeleteExpired(now time.Time) (int, error) {
+	var n int
+	for ep, m := range s.m {
+		for handle, a := range m {
+			if !a.Valid(now) {
+				delete(m, handle)
+				n++
+			}
+		}
+		if len(m) == 0 {
+			delete(s.m, ep)
+		}
+	}
+	return n, nil
+}
+
 // DefaultAssociationStore is the AssociationStore that will be used if no AssociationStore
 // is specified.
 var DefaultAssociationStore AssociationStore = NewMemoryAssociationStore()
 
-func (h *Handler) getAssociation(requestHandle, nonce string) (a *Association, err error) {
+func (h *Handler) getAssociation(ctx context.Context, endpoint, requestHandle, nonce, realm string) (a *Association, err error) {
+	if h.AssociationKey != nil {
+		return h.getDerivedAssociation(endpoint, requestHandle)
+	}
 	store := h.Associations
 	if store == nil {
 		store = DefaultAssociationStore
 	}
+	var secret []byte
+	if h.RealmKey != nil && h.NewAssociation == nil {
+		secret = realmSecret(h.RealmKey, realm)
+	}
 	if requestHandle != "" {
-		a, err = store.Get("", requestHandle)
+		a, err = h.lookupAssociation(ctx, store, endpoint, requestHandle)
 		if err != nil {
 			return
 		}
 		if a != nil {
-			if time.Now().Before(a.Expires) {
+			if h.reusable(a) && (secret == nil || hmac.Equal(a.Secret, secret)) {
 				return
 			}
-			store.Delete("", requestHandle)
+			if !a.Valid(h.clock()) {
+				storeDelete(ctx, store, endpoint, requestHandle)
+			}
 		}
 	}
-	secret := make([]byte, 128)
-	if _, err = rand.Read(secret); err != nil {
-		return
-	}
-	a = &Association{
-		Secret:  secret,
-		Type:    hmacSHA256,
-		Expires: time.Now().Add(time.Minute),
+	if h.NewAssociation != nil {
+		a, err = h.newAssociation(endpoint)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if secret == nil {
+			secret = make([]byte, 128)
+			if _, err = rand.Read(secret); err != nil {
+				return
+			}
+		}
+		a = &Association{
+			Secret: secret,
+			Type:   hmacSHA256,
+		}
 	}
-	err = saveAssociation(store, a)
+	a.Endpoint = endpoint
+	a.Expires = h.clock().Add(associationLifetime)
+	err = h.saveAssociation(ctx, store, a)
 	if err != nil {
 		a = nil
 	}
 	return
 }
 
+// newAssociation creates a new association for the OP endpoint using
+// the handler's NewAssociation function.
+func (h *Handler) newAssociation(endpoint string) (*Association, error) {
+	a, err := h.NewAssociation(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, errors.New("no association created")
+	}
+	switch a.Type {
+	case hmacSHA1, hmacSHA256:
+	default:
+		return nil, fmt.Errorf("cannot use new association: unsupported association type %q", a.Type)
+	}
+	if a.Secret == nil && a.Signer == nil {
+		return nil, errors.New("cannot use new association: no secret or signer")
+	}
+	return a, nil
+}
+
+// associationFor returns the association chosen by the handler's
+// AssociationFor hook to sign the assertion for req from the OP at
+// endpoint. A nil association is returned if the hook does not choose
+// one, or if the association it chooses expires too soon to be used.
+func (h *Handler) associationFor(req *LoginRequest, endpoint string) (*Association, error) {
+	a, err := h.AssociationFor(req)
+	if err != nil || a == nil {
+		return nil, err
+	}
+	switch a.Type {
+	case hmacSHA1, hmacSHA256:
+	default:
+		return nil, fmt.Errorf("cannot use association %q: unsupported association type %q", a.Handle, a.Type)
+	}
+	if a.Secret == nil && a.Signer == nil {
+		return nil, fmt.Errorf("cannot use association %q: no secret or signer", a.Handle)
+	}
+	if a.Handle == "" || !strings.HasPrefix(a.Handle, h.HandlePrefix) {
+		return nil, fmt.Errorf("cannot use association %q: handle does not start with %q", a.Handle, h.HandlePrefix)
+	}
+	if a.Endpoint != "" && a.Endpoint != endpoint {
+		return nil, fmt.Errorf("cannot use association %q: issued for OP endpoint %q", a.Handle, a.Endpoint)
+	}
+	if !h.reusable(a) {
+		h.debugf("association %q expires too soon, creating a new association", a.Handle)
+		return nil, nil
+	}
+	return a, nil
+}
+
+// defaultExpiryMargin is the ExpiryMargin used if none is specified.
+const defaultExpiryMargin = 5 * time.Second
+
+// reusable reports whether a may be used to sign a new response, that
+// is whether it remains valid for at least the handler's ExpiryMargin.
+func (h *Handler) reusable(a *Association) bool {
+	margin := h.ExpiryMargin
+	if margin == 0 {
+		margin = defaultExpiryMargin
+	} else if margin < 0 {
+		margin = 0
+	}
+	return h.clock().Add(margin).Before(a.Expires)
+}
+
+// realmSecret derives the association secret to use for the given
+// realm from key.
+func realmSecret(key []byte, realm string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(realm))
+	return h.Sum(nil)
+}
+
 func (h *Handler) associate(params map[string]string) (map[string]string, error) {
 	//	store := h.Associations
 	//	if store == nil {
 	//		assocs = DefaultAssociationStore
 	//	}
 
+	for _, k := range []string{"assoc_type", "session_type"} {
+		if params[k] == "" {
+			return nil, missingParamError(k)
+		}
+	}
+
+	switch params["assoc_type"] {
+	case hmacSHA1, hmacSHA256:
+	default:
+		return nil, unsupportedAssocTypeError(params["assoc_type"])
+	}
+
 	switch params["session_type"] {
 	//	case "DH-SHA1":
 	//	case "DH-SHA256":
@@ -188,27 +475,45 @@ func (h *Handler) associate(params map[string]string) (map[string]string, error)
 	}
 }
 
-func (h *Handler) checkAuthentication(params map[string]string) (map[string]string, error) {
+func (h *Handler) checkAuthentication(ctx context.Context, params map[string]string) (map[string]string, error) {
 	store := h.Associations
 	if store == nil {
 		store = DefaultAssociationStore
 	}
-	assoc, err := store.Get("", params["assoc_handle"])
+	assoc, err := h.lookupAssociation(ctx, store, params["op_endpoint"], params["assoc_handle"])
 	if err != nil {
 		return nil, err
 	}
-	if assoc == nil {
+	if assoc == nil || !assoc.Valid(h.clock()) {
+		return map[string]string{
+			"ns":       Namespace,
+			"is_valid": "false",
+		}, nil
+	}
+	if _, _, err := parseNonceTime(params["response_nonce"]); err != nil {
+		h.debugf("check_authentication: %s", err)
 		return map[string]string{
 			"ns":       Namespace,
 			"is_valid": "false",
 		}, nil
 	}
 	signed := strings.Split(params["signed"], ",")
-	sig, err := assoc.sign(params, signed)
+	sig, err := assoc.sign(params, signed, h.SignatureLengths[assoc.Type])
 	if err != nil {
 		return nil, err
 	}
-	if params["sig"] != sig {
+	if !hmac.Equal([]byte(params["sig"]), []byte(sig)) && h.LenientSignedOrder {
+		// Some relying parties reorder the signed list, try
+		// again with the fields in canonical order.
+		sorted := append([]string(nil), signed...)
+		sort.Strings(sorted)
+		sig, err = assoc.sign(params, sorted, h.SignatureLengths[assoc.Type])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !hmac.Equal([]byte(params["sig"]), []byte(sig)) {
+		h.debugf("signature mismatch for %q: expected signature digest %s, received %s, signed %q", assoc.Handle, sigDigest(sig), sigDigest(params["sig"]), params["signed"])
 		return map[string]string{
 			"ns":       Namespace,
 			"is_valid": "false",
@@ -219,30 +524,253 @@ func (h *Handler) checkAuthentication(params map[string]string) (map[string]stri
 		"is_valid": "true",
 	}
 	// TODO: deal with invalid_handle
-	store.Delete("", assoc.Handle)
+	storeDelete(ctx, store, assoc.Endpoint, assoc.Handle)
 	return rparams, nil
 }
 
-func saveAssociation(store AssociationStore, a *Association) error {
+// sigDigest returns a short digest of the signature sig, which allows
+// signatures to be told apart in logs without revealing them.
+func sigDigest(sig string) string {
+	d := sha256.Sum256([]byte(sig))
+	return hex.EncodeToString(d[:4])
+}
+
+// lookupAssociation retrieves the association for the OP endpoint with
+// the given handle from store. Handles that do not start with the
+// handler's HandlePrefix were not issued by this handler and are never
+// found.
+func (h *Handler) lookupAssociation(ctx context.Context, store AssociationStore, endpoint, handle string) (*Association, error) {
+	if !strings.HasPrefix(handle, h.HandlePrefix) {
+		return nil, nil
+	}
+	if h.AssociationKey != nil {
+		return h.derivedAssociation(endpoint, handle)
+	}
+	a, err := storeGet(ctx, store, endpoint, handle)
+	if err != nil {
+		return nil, h.storeError(ctx, err)
+	}
+	return a, nil
+}
+
+// validHandle reports whether the handler has a valid association for
+// the OP endpoint with the given handle.
+func (h *Handler) validHandle(ctx context.Context, endpoint, handle string) (bool, error) {
+	store := h.Associations
+	if store == nil {
+		store = DefaultAssociationStore
+	}
+	a, err := h.lookupAssociation(ctx, store, endpoint, handle)
+	if err != nil {
+		return false, err
+	}
+	return a != nil && a.Valid(h.clock()), nil
+}
+
+// saveAssociation adds a to store with a newly generated handle.
+func (h *Handler) saveAssociation(ctx context.Context, store AssociationStore, a *Association) error {
 	for i := 0; i < 10; i++ {
-		var handle [16]byte
-		if _, err := rand.Read(handle[:]); err != nil {
+		handle, err := h.randomHandle()
+		if err != nil {
 			return err
 		}
-		ehandle := make([]byte, ascii85.MaxEncodedLen(len(handle)))
-		n := ascii85.Encode(ehandle, handle[:])
-		a.Handle = string(ehandle[:n])
-		err := store.Add(a)
+		a.Handle = h.HandlePrefix + handle
+		err = storeAdd(ctx, store, a)
 		if err == nil {
 			return nil
 		}
 		if err != ErrDuplicateAssociation {
-			return err
+			return h.storeError(ctx, err)
 		}
 	}
 	return errors.New("cannot store association")
 }
 
+// randomHandle generates the part of a new association handle that
+// follows the HandlePrefix, using the handler's Generator.
+func (h *Handler) randomHandle() (string, error) {
+	handle, err := h.generator().Handle()
+	if err != nil {
+		return "", err
+	}
+	if err := validGenerated("handle", handle); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+// getDerivedAssociation returns the derived association with
+// requestHandle if it is still valid, otherwise it creates a new
+// derived association.
+func (h *Handler) getDerivedAssociation(endpoint, requestHandle string) (*Association, error) {
+	if requestHandle != "" && strings.HasPrefix(requestHandle, h.HandlePrefix) {
+		a, err := h.derivedAssociation(endpoint, requestHandle)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil && h.reusable(a) {
+			return a, nil
+		}
+	}
+	handle, err := h.randomHandle()
+	if err != nil {
+		return nil, err
+	}
+	expires := h.clock().Add(associationLifetime).Unix()
+	return h.derivedAssociation(endpoint, h.HandlePrefix+strconv.FormatInt(expires, 10)+"."+handle)
+}
+
+// derivedAssociation returns the association for the OP endpoint with
+// the given handle, whose secret is derived from the handler's
+// AssociationKey, the endpoint and the handle. The handle encodes the
+// association's expiry time. If the handle is not that of a derived
+// association, or its expiry time is further away than the handler
+// could have issued, nil is returned. Derived associations cannot be
+// deleted once used, so without this limit a handle chosen by a
+// relying party could be used to sign assertions that verify forever.
+func (h *Handler) derivedAssociation(endpoint, handle string) (*Association, error) {
+	parts := strings.SplitN(strings.TrimPrefix(handle, h.HandlePrefix), ".", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	expires := time.Unix(n, 0)
+	if expires.After(h.clock().Add(associationLifetime + validityGrace)) {
+		return nil, nil
+	}
+	return &Association{
+		Endpoint: endpoint,
+		Handle:   handle,
+		Secret:   hkdfSHA256(h.AssociationKey, []byte(endpoint), handle),
+		Type:     hmacSHA256,
+		Expires:  expires,
+	}, nil
+}
+
+// hkdfSHA256 derives a 32 byte key from secret, salt and info using
+// HKDF-SHA256 as defined in RFC 5869. Only a single block of output is
+// needed, so only the first round of the expand step is performed.
+func hkdfSHA256(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// AssociationInfo describes an association without revealing its
+// secret.
+type AssociationInfo struct {
+	Handle  string
+	Type    string
+	Expires time.Time
+}
+
+// ListAssociations returns a description of each of the handler's
+// valid associations for the specified OP endpoint. The association
+// secrets are not included.
+func (h *Handler) ListAssociations(endpoint string) ([]AssociationInfo, error) {
+	store := h.Associations
+	if store == nil {
+		store = DefaultAssociationStore
+	}
+	assocs, err := store.Find(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var infos []AssociationInfo
+	now := h.clock()
+	for _, a := range assocs {
+		if !strings.HasPrefix(a.Handle, h.HandlePrefix) || !a.Valid(now) {
+			continue
+		}
+		infos = append(infos, AssociationInfo{
+			Handle:  a.Handle,
+			Type:    a.Type,
+			Expires: a.Expires,
+		})
+	}
+	return infos, nil
+}
+
+// readinessEndpoint is the endpoint used for the associations created
+// by Ready.
+const readinessEndpoint = "openid2:readiness-probe"
+
+// Ready checks that the handler's AssociationStore is available by
+// adding, retrieving and deleting a short-lived probe association. It
+// is intended for use in readiness checks.
+func (h *Handler) Ready(ctx context.Context) error {
+	store := h.Associations
+	if store == nil {
+		store = DefaultAssociationStore
+	}
+	handle, err := h.randomHandle()
+	if err != nil {
+		return err
+	}
+	a := &Association{
+		Endpoint: readinessEndpoint,
+		Handle:   h.HandlePrefix + handle,
+		Type:     hmacSHA256,
+		Expires:  h.clock().Add(time.Minute),
+	}
+	if err := storeAdd(ctx, store, a); err != nil {
+		return probeError(ctx, "add", err)
+	}
+	defer store.Delete(a.Endpoint, a.Handle)
+	a1, err := storeGet(ctx, store, a.Endpoint, a.Handle)
+	if err != nil {
+		return probeError(ctx, "get", err)
+	}
+	if a1 == nil {
+		return errors.New("added association not found")
+	}
+	if err := storeDelete(ctx, store, a.Endpoint, a.Handle); err != nil {
+		return probeError(ctx, "delete", err)
+	}
+	return nil
+}
+
+// probeError returns the error reported by Ready when the op store
+// operation fails with err. If ctx is done its error is returned.
+func probeError(ctx context.Context, op string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("cannot %s association: %s", op, err)
+}
+
+// errStoreUnavailable is reported to requesters when the
+// AssociationStore fails, so that the details are not leaked.
+var errStoreUnavailable = storeUnavailableError{errors.New("association store temporarily unavailable, please try again later")}
+
+type storeUnavailableError struct {
+	error
+}
+
+// httpStatus implements httpStatuser. The request may succeed if
+// retried once the store recovers.
+func (storeUnavailableError) httpStatus() int {
+	return http.StatusServiceUnavailable
+}
+
+// storeError logs err, which was returned from an AssociationStore, and
+// returns the error that should be reported to the requester. If ctx
+// is done its error is returned instead, as the store operation was
+// abandoned rather than failing.
+func (h *Handler) storeError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	h.logf("association store error: %s", err)
+	return errStoreUnavailable
+}
+
 type unsupportedSessionTypeError string
 
 func (e unsupportedSessionTypeError) Error() string {
@@ -254,3 +782,18 @@ func (e unsupportedSessionTypeError) errorParams() map[string]string {
 		"error-code": "unsupported-type",
 	}
 }
+
+type unsupportedAssocTypeError string
+
+func (e unsupportedAssocTypeError) Error() string {
+	return fmt.Sprintf("association type %q not supported", string(e))
+}
+
+// errorParams implements errorParamser. No assoc_type or session_type
+// is suggested until associate is implemented, as a relying party
+// retrying with the suggestion would fail again.
+func (e unsupportedAssocTypeError) errorParams() map[string]string {
+	return map[string]string{
+		"error-code": "unsupported-type",
+	}
+}
@@ -0,0 +1,767 @@
+package openid2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssociateUnsupportedAssocType(t *testing.T) {
+	h := &Handler{Associations: NewMemoryAssociationStore()}
+	rec := serve(h, "POST", map[string]string{
+		"ns":           Namespace,
+		"mode":         "associate",
+		"assoc_type":   "HMAC-MD5",
+		"session_type": "no-encryption",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+	p := directParams(t, rec)
+	expect := map[string]string{
+		"ns":         Namespace,
+		"mode":       "error",
+		"error":      `association type "HMAC-MD5" not supported`,
+		"error-code": "unsupported-type",
+	}
+	for k, v := range expect {
+		if p[k] != v {
+			t.Errorf("unexpected %s %q, expected %q", k, p[k], v)
+		}
+	}
+}
+
+func TestAssociateMissingSessionType(t *testing.T) {
+	h := &Handler{Associations: NewMemoryAssociationStore()}
+	rec := serve(h, "POST", map[string]string{
+		"ns":         Namespace,
+		"mode":       "associate",
+		"assoc_type": "HMAC-SHA256",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+	p := directParams(t, rec)
+	if p["ns"] != Namespace || p["mode"] != "error" || p["error"] != "missing session_type parameter" {
+		t.Errorf("unexpected response %v", p)
+	}
+}
+
+func TestUnsupportedAssocTypeErrorParams(t *testing.T) {
+	p := makeError(unsupportedAssocTypeError("HMAC-MD5"))
+	if p["error-code"] != "unsupported-type" {
+		t.Errorf("unexpected error-code %q", p["error-code"])
+	}
+	// No association is supported yet, so none is suggested.
+	for _, k := range []string{"assoc_type", "session_type"} {
+		if v, ok := p[k]; ok {
+			t.Errorf("unexpected suggested %s %q", k, v)
+		}
+	}
+}
+
+func TestSignatureMismatchDebugLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := newTestHandler(approve())
+	h.Debug = true
+	h.Logger = log.New(&buf, "", 0)
+	p := checkid(t, h, nil)
+	assoc, err := h.Associations.Get(testEndpoint, p["assoc_handle"])
+	if err != nil || assoc == nil {
+		t.Fatalf("cannot get association: %v", err)
+	}
+	p["return_to"] = testReturnTo + "&tampered=1"
+	expected, err := assoc.sign(p, strings.Split(p["signed"], ","), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if v := verify(t, h, p); v != "false" {
+		t.Fatalf("unexpected is_valid %q for tampered assertion", v)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "signature mismatch") || !strings.Contains(out, p["signed"]) {
+		t.Errorf("signed fields not logged: %q", out)
+	}
+	for _, secret := range []string{
+		string(assoc.Secret),
+		base64.StdEncoding.EncodeToString(assoc.Secret),
+		hex.EncodeToString(assoc.Secret),
+		expected,
+		p["sig"],
+	} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output contains secret value %q: %q", secret, out)
+		}
+	}
+	if !strings.Contains(out, sigDigest(expected)) || !strings.Contains(out, sigDigest(p["sig"])) {
+		t.Errorf("signature digests not logged: %q", out)
+	}
+}
+
+// testStores holds constructors for each of the package's
+// AssociationStore implementations.
+var testStores = []struct {
+	name     string
+	newStore func() AssociationStore
+}{{
+	name:     "Memory",
+	newStore: func() AssociationStore { return NewMemoryAssociationStore() },
+}, {
+	name:     "LRU",
+	newStore: func() AssociationStore { return NewLRUAssociationStore(100) },
+}, {
+	name:     "Tiered",
+	newStore: func() AssociationStore { return NewTieredAssociationStore(NewMemoryAssociationStore()) },
+}}
+
+// testAssociation creates an association for endpoint with the given
+// handle that expires after d.
+func testAssociation(endpoint, handle string, d time.Duration) *Association {
+	return &Association{
+		Endpoint: endpoint,
+		Handle:   handle,
+		Secret:   []byte("secret-" + handle),
+		Type:     hmacSHA256,
+		Expires:  time.Now().Add(d),
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	for _, test := range testStores {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.newStore()
+			for _, a := range []*Association{
+				testAssociation("https://op1.example.com/", "h1", time.Hour),
+				testAssociation("https://op1.example.com/", "h2", time.Hour),
+				testAssociation("https://op2.example.com/", "h3", time.Hour),
+			} {
+				if err := s.Add(a); err != nil {
+					t.Fatalf("Add: %s", err)
+				}
+			}
+			if err := s.DeleteAll("https://op1.example.com/"); err != nil {
+				t.Fatalf("DeleteAll: %s", err)
+			}
+			for _, h := range []string{"h1", "h2"} {
+				if a, err := s.Get("https://op1.example.com/", h); err != nil || a != nil {
+					t.Errorf("Get(%q) after DeleteAll returned %v, %v", h, a, err)
+				}
+			}
+			if a, err := s.Get("https://op2.example.com/", "h3"); err != nil || a == nil {
+				t.Errorf("association for other endpoint removed: %v, %v", a, err)
+			}
+		})
+	}
+}
+
+// testSigner is a Signer holding its key outside of any Association,
+// as an HSM or KMS backed Signer would.
+type testSigner struct {
+	key   []byte
+	calls int
+}
+
+func (s *testSigner) Sign(assocType string, base []byte) ([]byte, error) {
+	s.calls++
+	return hmacSigner(s.key).Sign(assocType, base)
+}
+
+func TestNewAssociationSigner(t *testing.T) {
+	signer := &testSigner{key: []byte("key held by the signer")}
+	h := newTestHandler(approve())
+	h.NewAssociation = func(endpoint string) (*Association, error) {
+		if endpoint != testEndpoint {
+			t.Errorf("NewAssociation called with endpoint %q, expected %q", endpoint, testEndpoint)
+		}
+		return &Association{
+			Type:   hmacSHA256,
+			Signer: signer,
+		}, nil
+	}
+	p := checkid(t, h, nil)
+	if p["mode"] != "id_res" {
+		t.Fatalf("unexpected mode %q", p["mode"])
+	}
+	if signer.calls != 1 {
+		t.Errorf("signer called %d times to sign, expected 1", signer.calls)
+	}
+	a, err := h.Associations.Get(testEndpoint, p["assoc_handle"])
+	if err != nil || a == nil {
+		t.Fatalf("cannot get association: %v", err)
+	}
+	if a.Secret != nil {
+		t.Errorf("association has in process secret %x", a.Secret)
+	}
+	expect, err := Association{Type: hmacSHA256, Secret: signer.key}.sign(p, strings.Split(p["signed"], ","), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p["sig"] != expect {
+		t.Errorf("unexpected signature %q, expected %q", p["sig"], expect)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+	}
+	if signer.calls != 2 {
+		t.Errorf("signer called %d times, expected 2", signer.calls)
+	}
+}
+
+func TestNewAssociationInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		assoc *Association
+		err   string
+	}{{
+		name:  "NoKey",
+		assoc: &Association{Type: hmacSHA256},
+		err:   "cannot use new association: no secret or signer",
+	}, {
+		name:  "BadType",
+		assoc: &Association{Type: "HMAC-MD5", Secret: []byte("secret")},
+		err:   `cannot use new association: unsupported association type "HMAC-MD5"`,
+	}, {
+		name: "Nil",
+		err:  "no association created",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHandler(approve())
+			h.TrustedReturnTo = func(string) bool { return true }
+			h.NewAssociation = func(string) (*Association, error) {
+				return test.assoc, nil
+			}
+			p := checkid(t, h, nil)
+			if p["mode"] != "error" || p["error"] != test.err {
+				t.Errorf("unexpected response %q: %q, expected error %q", p["mode"], p["error"], test.err)
+			}
+		})
+	}
+}
+
+func TestAssociationSigner(t *testing.T) {
+	signer := &testSigner{key: []byte("key")}
+	a := &Association{Handle: "h", Type: hmacSHA256, Signer: signer}
+	params := map[string]string{
+		"mode":         "id_res",
+		"assoc_handle": "h",
+		"signed":       "mode,assoc_handle",
+	}
+	sig, err := a.sign(params, []string{"mode", "assoc_handle"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.calls != 1 {
+		t.Errorf("signer called %d times, expected 1", signer.calls)
+	}
+	expect, err := Association{Type: hmacSHA256, Secret: signer.key}.sign(params, []string{"mode", "assoc_handle"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig != expect {
+		t.Errorf("unexpected signature %q, expected %q", sig, expect)
+	}
+}
+
+func TestRealmKey(t *testing.T) {
+	h := newTestHandler(approve())
+	h.RealmKey = []byte("master key")
+	realms := []struct {
+		realm, returnTo string
+	}{
+		{"https://rp1.example.com/", "https://rp1.example.com/return"},
+		{"https://rp2.example.com/", "https://rp2.example.com/return"},
+	}
+	var assertions []map[string]string
+	for _, r := range realms {
+		p := checkid(t, h, map[string]string{
+			"realm":     r.realm,
+			"return_to": r.returnTo,
+		})
+		if p["mode"] != "id_res" {
+			t.Fatalf("unexpected mode %q", p["mode"])
+		}
+		assertions = append(assertions, p)
+	}
+	for i, p := range assertions {
+		for j, r := range realms {
+			a := &Association{Type: hmacSHA256, Secret: realmSecret(h.RealmKey, r.realm)}
+			ok, err := VerifyAssertion(a, p, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (i == j) {
+				t.Errorf("assertion for %q verified with key for %q: %v", realms[i].realm, r.realm, ok)
+			}
+		}
+	}
+	for _, p := range assertions {
+		if v := verify(t, h, p); v != "true" {
+			t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+		}
+	}
+}
+
+func TestSignatureLengths(t *testing.T) {
+	h := newTestHandler(approve())
+	h.SignatureLengths = map[string]int{"HMAC-SHA256": 20}
+	p := checkid(t, h, nil)
+	sig, err := base64.URLEncoding.DecodeString(p["sig"])
+	if err != nil {
+		t.Fatalf("cannot decode sig %q: %s", p["sig"], err)
+	}
+	if len(sig) != 20 {
+		t.Errorf("unexpected signature length %d, expected 20", len(sig))
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("truncated signature not verified: is_valid %q", v)
+	}
+	p["identity"] = "https://op.example.com/id/mallory"
+	if v := verify(t, h, p); v != "false" {
+		t.Errorf("tampered assertion verified: is_valid %q", v)
+	}
+
+	h.SignatureLengths = nil
+	p = checkid(t, h, nil)
+	sig, err = base64.URLEncoding.DecodeString(p["sig"])
+	if err != nil {
+		t.Fatalf("cannot decode sig %q: %s", p["sig"], err)
+	}
+	if len(sig) != 32 {
+		t.Errorf("unexpected signature length %d, expected 32", len(sig))
+	}
+}
+
+func TestHandlePrefixIsolation(t *testing.T) {
+	store := NewMemoryAssociationStore()
+	a := newTestHandler(approve())
+	a.Associations = store
+	a.HandlePrefix = "a-"
+	b := newTestHandler(approve())
+	b.Associations = store
+	b.HandlePrefix = "b-"
+
+	pa := checkid(t, a, nil)
+	handle := pa["assoc_handle"]
+	if !strings.HasPrefix(handle, "a-") {
+		t.Fatalf("handle %q does not have prefix %q", handle, "a-")
+	}
+	if v := verify(t, b, pa); v != "false" {
+		t.Errorf("other tenant's assertion verified: is_valid %q", v)
+	}
+	if v := verify(t, a, pa); v != "true" {
+		t.Errorf("assertion not verified: is_valid %q", v)
+	}
+
+	pb := checkid(t, b, map[string]string{"assoc_handle": handle})
+	if pb["assoc_handle"] == handle || !strings.HasPrefix(pb["assoc_handle"], "b-") {
+		t.Errorf("other tenant's handle used: %q", pb["assoc_handle"])
+	}
+	if v := verify(t, a, pb); v != "false" {
+		t.Errorf("other tenant's assertion verified: is_valid %q", v)
+	}
+	if v := verify(t, b, pb); v != "true" {
+		t.Errorf("assertion not verified: is_valid %q", v)
+	}
+}
+
+func TestHandleCharacters(t *testing.T) {
+	h := newTestHandler(approve())
+	for i := 0; i < 50; i++ {
+		handle := checkid(t, h, nil)["assoc_handle"]
+		if handle == "" {
+			t.Fatal("no assoc_handle in response")
+		}
+		for _, c := range handle {
+			if !strings.ContainsRune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_", c) {
+				t.Fatalf("handle %q contains unsafe character %q", handle, c)
+			}
+		}
+	}
+
+	h.HandleEncoding = hex.EncodeToString
+	handle := checkid(t, h, nil)["assoc_handle"]
+	if _, err := hex.DecodeString(handle); err != nil {
+		t.Errorf("handle %q not encoded with HandleEncoding: %s", handle, err)
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := &Association{Type: hmacSHA256, Secret: []byte("secret")}
+	params := map[string]string{
+		"mode":       "id_res",
+		"identity":   testID,
+		"claimed_id": testID,
+		"return_to":  testReturnTo,
+		"signed":     "mode,identity,claimed_id,return_to",
+	}
+	signed := strings.Split(params["signed"], ",")
+	for _, length := range []int{0, 20} {
+		p := make(map[string]string)
+		for k, v := range params {
+			p[k] = v
+		}
+		sig, err := a.sign(p, signed, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p["sig"] = sig
+		ok, err := VerifyAssertion(a, p, length)
+		if err != nil || !ok {
+			t.Errorf("length %d: valid assertion not verified: %v, %v", length, ok, err)
+		}
+		other := 20 - length
+		if ok, _ := VerifyAssertion(a, p, other); ok {
+			t.Errorf("length %d: assertion verified with length %d", length, other)
+		}
+		p["identity"] = "https://op.example.com/id/mallory"
+		if ok, _ := VerifyAssertion(a, p, length); ok {
+			t.Errorf("length %d: tampered assertion verified", length)
+		}
+	}
+	if ok, err := VerifyAssertion(a, map[string]string{"mode": "id_res"}, 0); ok || err != nil {
+		t.Errorf("unsigned assertion: unexpected result %v, %v", ok, err)
+	}
+}
+
+func TestHandleCheckAuthenticationRoundTrip(t *testing.T) {
+	h := newTestHandler(approve())
+	for i := 0; i < 20; i++ {
+		p := checkid(t, h, nil)
+		var buf bytes.Buffer
+		if err := EncodeKeyValue(&buf, p); err != nil {
+			t.Fatalf("cannot encode %v: %s", p, err)
+		}
+		kv, err := ParseKeyValue(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", buf.String(), err)
+		}
+		if kv["assoc_handle"] != p["assoc_handle"] {
+			t.Fatalf("handle %q changed to %q in key-value form", p["assoc_handle"], kv["assoc_handle"])
+		}
+		if v := verify(t, h, kv); v != "true" {
+			t.Errorf("handle %q: unexpected is_valid %q", p["assoc_handle"], v)
+		}
+	}
+}
+
+// errStore is an AssociationStore for which every operation fails.
+type errStore struct{}
+
+var errStoreDown = errors.New("dial tcp store.internal:6379: connection refused")
+
+func (errStore) Add(*Association) error                   { return errStoreDown }
+func (errStore) Get(string, string) (*Association, error) { return nil, errStoreDown }
+func (errStore) Find(string) ([]*Association, error)      { return nil, errStoreDown }
+func (errStore) Delete(string, string) error              { return errStoreDown }
+func (errStore) DeleteAll(string) error                   { return errStoreDown }
+
+func TestStoreUnavailable(t *testing.T) {
+	var buf bytes.Buffer
+	h := newTestHandler(approve())
+	h.Associations = errStore{}
+	h.Logger = log.New(&buf, "", 0)
+
+	// Errors are sent directly as the return_to is not trusted.
+	rec := serve(h, "GET", map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+	})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	p := directParams(t, rec)
+	if p["mode"] != "error" || p["error"] != errStoreUnavailable.Error() {
+		t.Errorf("unexpected response %v", p)
+	}
+	rec = serve(h, "POST", map[string]string{
+		"ns":           Namespace,
+		"mode":         "check_authentication",
+		"assoc_handle": "handle",
+		"signed":       "mode",
+		"sig":          "c2ln",
+	})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("check_authentication: unexpected status %d, expected %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	p = directParams(t, rec)
+	if p["is_valid"] == "true" {
+		t.Errorf("assertion verified without a store: %v", p)
+	}
+	for k, v := range p {
+		if strings.Contains(v, "store.internal") {
+			t.Errorf("store error leaked in %s: %q", k, v)
+		}
+	}
+	if !strings.Contains(buf.String(), errStoreDown.Error()) {
+		t.Errorf("store error not logged: %q", buf.String())
+	}
+}
+
+func TestInjectedClock(t *testing.T) {
+	now := time.Now()
+	h := newTestHandler(approve())
+	h.now = func() time.Time { return now }
+	p := checkid(t, h, nil)
+	if v := verify(t, h, p); v != "true" {
+		t.Fatalf("unexpected is_valid %q, expected %q", v, "true")
+	}
+	now = now.Add(2 * time.Minute)
+	if v := verify(t, h, p); v != "false" {
+		t.Errorf("assertion verified after its association expired: is_valid %q", v)
+	}
+}
+
+func TestAssociationValid(t *testing.T) {
+	expires := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := Association{Expires: expires}
+	tests := []struct {
+		now   time.Time
+		valid bool
+	}{
+		{expires.Add(-time.Hour), true},
+		{expires.Add(-time.Nanosecond), true},
+		{expires, true},
+		{expires.Add(validityGrace - time.Nanosecond), true},
+		{expires.Add(validityGrace), false},
+		{expires.Add(time.Hour), false},
+	}
+	for _, test := range tests {
+		if v := a.Valid(test.now); v != test.valid {
+			t.Errorf("Valid(%s) = %v, expected %v", test.now, v, test.valid)
+		}
+	}
+}
+
+func TestLenientSignedOrder(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		h := newTestHandler(approve())
+		h.LenientSignedOrder = lenient
+		p := checkid(t, h, nil)
+		signed := strings.Split(p["signed"], ",")
+		if v := verify(t, h, p); v != "true" {
+			t.Errorf("lenient %v: assertion not verified: is_valid %q", lenient, v)
+		}
+
+		p = checkid(t, h, nil)
+		reversed := make([]string, len(signed))
+		for i, k := range signed {
+			reversed[len(signed)-1-i] = k
+		}
+		p["signed"] = strings.Join(reversed, ",")
+		expect := "false"
+		if lenient {
+			expect = "true"
+		}
+		if v := verify(t, h, p); v != expect {
+			t.Errorf("lenient %v: reordered signed list: is_valid %q, expected %q", lenient, v, expect)
+		}
+	}
+}
+
+func TestAssociationKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newNode := func(key []byte) *Handler {
+		h := newTestHandler(approve())
+		h.AssociationKey = key
+		return h
+	}
+	a, b := newNode(key), newNode(key)
+	p := checkid(t, a, nil)
+	if v := verify(t, b, p); v != "true" {
+		t.Errorf("assertion not verified by another node: is_valid %q", v)
+	}
+	if as, _ := b.Associations.Find(testEndpoint); len(as) != 0 {
+		t.Errorf("derived association stored: %v", as)
+	}
+	if v := verify(t, newNode([]byte("another key")), p); v != "false" {
+		t.Errorf("assertion verified with a different key: is_valid %q", v)
+	}
+
+	// The expiry time in the handle is covered by the secret.
+	parts := strings.SplitN(p["assoc_handle"], ".", 2)
+	forged := make(map[string]string)
+	for k, v := range p {
+		forged[k] = v
+	}
+	forged["assoc_handle"] = "9999999999." + parts[1]
+	if v := verify(t, b, forged); v != "false" {
+		t.Errorf("assertion with forged expiry verified: is_valid %q", v)
+	}
+
+	now := time.Now().Add(2 * time.Minute)
+	b.now = func() time.Time { return now }
+	if v := verify(t, b, p); v != "false" {
+		t.Errorf("expired assertion verified: is_valid %q", v)
+	}
+}
+
+func TestAssociationKeyForgedHandle(t *testing.T) {
+	now := time.Now()
+	h := newTestHandler(approve())
+	h.AssociationKey = []byte("0123456789abcdef0123456789abcdef")
+	h.now = func() time.Time { return now }
+
+	// A relying party cannot choose a far-future handle to sign
+	// with.
+	forged := "99999999999.forged"
+	p := checkid(t, h, map[string]string{"assoc_handle": forged})
+	if p["mode"] != "id_res" || p["assoc_handle"] == forged {
+		t.Fatalf("forged handle used: %v", p)
+	}
+	if p["invalidate_handle"] != forged {
+		t.Errorf("unexpected invalidate_handle %q, expected %q", p["invalidate_handle"], forged)
+	}
+
+	// Nor is an assertion signed with such a handle verified.
+	a := &Association{
+		Endpoint: testEndpoint,
+		Handle:   forged,
+		Secret:   hkdfSHA256(h.AssociationKey, []byte(testEndpoint), forged),
+		Type:     hmacSHA256,
+	}
+	fp, err := h.signResponse(a, p, strings.Split(p["signed"], ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := verify(t, h, fp); v != "false" {
+		t.Errorf("assertion with forged handle verified: is_valid %q", v)
+	}
+
+	// A derived association cannot be deleted after use, so the
+	// assertion verifies repeatedly, but only until it expires.
+	for i := 0; i < 3; i++ {
+		if v := verify(t, h, p); v != "true" {
+			t.Fatalf("verification %d: unexpected is_valid %q, expected %q", i, v, "true")
+		}
+	}
+	now = now.Add(associationLifetime + 2*validityGrace)
+	if v := verify(t, h, p); v != "false" {
+		t.Errorf("assertion verified after its association expired: is_valid %q", v)
+	}
+}
+
+func TestReady(t *testing.T) {
+	h := newTestHandler(nil)
+	if err := h.Ready(context.Background()); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if as, _ := h.Associations.Find(readinessEndpoint); len(as) != 0 {
+		t.Errorf("probe association not removed: %v", as)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.Ready(ctx); err != context.Canceled {
+		t.Errorf("unexpected error %v, expected %v", err, context.Canceled)
+	}
+
+	h.Associations = errStore{}
+	err := h.Ready(context.Background())
+	if err == nil || err.Error() != "cannot add association: "+errStoreDown.Error() {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSweepAssociations(t *testing.T) {
+	// plainStore hides any BatchDeleter implementation of the store
+	// it wraps.
+	type plainStore struct {
+		AssociationStore
+	}
+	for _, test := range testStores {
+		for _, batch := range []bool{true, false} {
+			store := test.newStore()
+			for _, a := range []*Association{
+				testAssociation("ep1", "live", time.Hour),
+				testAssociation("ep1", "expired1", -time.Hour),
+				testAssociation("ep2", "expired2", -time.Hour),
+			} {
+				if err := store.Add(a); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var sweep AssociationStore = store
+			if !batch {
+				sweep = plainStore{store}
+			}
+			n, err := SweepAssociations(sweep, time.Now(), "ep1", "ep2")
+			if err != nil {
+				t.Fatalf("%s (batch %v): %s", test.name, batch, err)
+			}
+			if n != 2 {
+				t.Errorf("%s (batch %v): %d associations removed, expected 2", test.name, batch, n)
+			}
+			for _, ep := range []string{"ep1", "ep2"} {
+				as, err := store.Find(ep)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, a := range as {
+					if a.Handle != "live" {
+						t.Errorf("%s (batch %v): association %q not removed", test.name, batch, a.Handle)
+					}
+				}
+			}
+			if a, _ := store.Get("ep1", "live"); a == nil {
+				t.Errorf("%s (batch %v): valid association removed", test.name, batch)
+			}
+		}
+	}
+}
+
+func TestListAssociationsOmitsExpired(t *testing.T) {
+	h := newTestHandler(nil)
+	for _, a := range []*Association{
+		testAssociation(testEndpoint, "live", time.Hour),
+		testAssociation(testEndpoint, "expired", -time.Hour),
+	} {
+		if err := h.Associations.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos, err := h.ListAssociations(testEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Handle != "live" {
+		t.Errorf("unexpected associations %v", infos)
+	}
+}
+
+func TestListAssociations(t *testing.T) {
+	h := newTestHandler(approve())
+	h.HandlePrefix = "op-"
+	p := checkid(t, h, nil)
+	if err := h.Associations.Add(testAssociation(testEndpoint, "other-tenant", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := h.ListAssociations(testEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Handle != p["assoc_handle"] || infos[0].Type != hmacSHA256 || infos[0].Expires.IsZero() {
+		t.Fatalf("unexpected associations %+v", infos)
+	}
+	a, err := h.Associations.Get(testEndpoint, p["assoc_handle"])
+	if err != nil || a == nil {
+		t.Fatalf("association not found: %v", err)
+	}
+	listing := fmt.Sprintf("%#v", infos)
+	for _, secret := range []string{string(a.Secret), fmt.Sprintf("%#v", a.Secret), base64.StdEncoding.EncodeToString(a.Secret)} {
+		if strings.Contains(listing, secret) {
+			t.Errorf("listing %s contains the association secret", listing)
+		}
+	}
+}
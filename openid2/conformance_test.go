@@ -0,0 +1,63 @@
+package openid2_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mhilton/openid/openid2"
+	"github.com/mhilton/openid/openid2/openid2test"
+)
+
+// approveAll is a LoginHandler that authenticates every request.
+type approveAll struct{}
+
+func (approveAll) Login(w http.ResponseWriter, r *http.Request, req *openid2.LoginRequest) (*openid2.LoginResponse, error) {
+	return &openid2.LoginResponse{
+		ClaimedID: "https://op.example.com/id/alice",
+		Identity:  "https://op.example.com/id/alice",
+	}, nil
+}
+
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *openid2.Handler
+	}{{
+		name: "NoLogin",
+		h: &openid2.Handler{
+			Associations: openid2.NewMemoryAssociationStore(),
+			OPEndpoint:   "https://op.example.com/",
+		},
+	}, {
+		name: "Login",
+		h: &openid2.Handler{
+			Login:        approveAll{},
+			Associations: openid2.NewMemoryAssociationStore(),
+			OPEndpoint:   "https://op.example.com/",
+		},
+	}, {
+		name: "AssociationKey",
+		h: &openid2.Handler{
+			Login:          approveAll{},
+			Associations:   openid2.NewLRUAssociationStore(100),
+			AssociationKey: []byte("0123456789abcdef0123456789abcdef"),
+			Nonces:         openid2.NewMemoryNonceStore(time.Hour),
+			OPEndpoint:     "https://op.example.com/",
+		},
+	}, {
+		name: "RealmKey",
+		h: &openid2.Handler{
+			Login:        approveAll{},
+			Associations: openid2.NewMemoryAssociationStore(),
+			RealmKey:     []byte("0123456789abcdef0123456789abcdef"),
+			HandlePrefix: "test-",
+			OPEndpoint:   "https://op.example.com/",
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			openid2test.RunConformance(t, test.h)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package openid2
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+const (
+	// ServerType is the service type of an OP Identifier Element.
+	ServerType = "http://specs.openid.net/auth/2.0/server"
+
+	// SignonType is the service type of a Claimed Identifier
+	// Element.
+	SignonType = "http://specs.openid.net/auth/2.0/signon"
+
+	// ReturnToType is the service type of a relying party's
+	// return_to URLs, used by an OP to verify a realm.
+	ReturnToType = "http://specs.openid.net/auth/2.0/return_to"
+)
+
+// XRDSHandler serves an XRDS document that allows relying parties to
+// discover an OP endpoint.
+type XRDSHandler struct {
+	// Endpoint is the URL of the OP endpoint.
+	Endpoint string
+
+	// Server causes the document to advertise the endpoint as an OP
+	// Identifier Element, allowing the user to be identified by the
+	// OP (directed identity).
+	Server bool
+
+	// Signon causes the document to advertise the endpoint as a
+	// Claimed Identifier Element, for serving at a claimed
+	// identifier.
+	Signon bool
+
+	// LocalID is the OP-Local Identifier included in the Claimed
+	// Identifier Element. It may be blank.
+	LocalID string
+
+	// Extensions holds the namespaces of the extensions supported by
+	// the OP, which are advertised as additional service types.
+	Extensions []string
+}
+
+// ServeHTTP implements http.Handler by writing the XRDS document.
+func (x *XRDSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	doc, err := x.document()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xrds+xml")
+	w.Write(doc)
+}
+
+// document generates the XRDS document. The OP Identifier Element, if
+// present, is given a higher priority than the Claimed Identifier
+// Element.
+func (x *XRDSHandler) document() ([]byte, error) {
+	var services []xrdsService
+	if x.Server {
+		services = append(services, xrdsService{
+			Priority: 0,
+			Types:    append([]string{ServerType}, x.Extensions...),
+			URIs:     []string{x.Endpoint},
+		})
+	}
+	if x.Signon {
+		services = append(services, xrdsService{
+			Priority: 10,
+			Types:    append([]string{SignonType}, x.Extensions...),
+			URIs:     []string{x.Endpoint},
+			LocalID:  x.LocalID,
+		})
+	}
+	return marshalXRDS(services)
+}
+
+// ReturnToXRDS generates an XRDS document advertising the given
+// return_to URLs of a relying party, as used by an OP for realm
+// verification.
+func ReturnToXRDS(returnTo ...string) ([]byte, error) {
+	return marshalXRDS([]xrdsService{{
+		Types: []string{ReturnToType},
+		URIs:  returnTo,
+	}})
+}
+
+// ReturnToXRDSHandler serves an XRDS document that allows an OP to
+// discover a relying party's return_to URLs. It should be served at the
+// realm.
+type ReturnToXRDSHandler struct {
+	// ReturnTo holds the return_to URLs used by the relying party.
+	ReturnTo []string
+}
+
+// ServeHTTP implements http.Handler by writing the XRDS document.
+func (x *ReturnToXRDSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	doc, err := ReturnToXRDS(x.ReturnTo...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xrds+xml")
+	w.Write(doc)
+}
+
+// xrds is the root element of an XRDS document.
+type xrds struct {
+	XMLName xml.Name `xml:"xri://$xrds XRDS"`
+	XRD     xrd
+}
+
+type xrd struct {
+	XMLName  xml.Name      `xml:"xri://$xrd*($v*2.0) XRD"`
+	Services []xrdsService `xml:"Service"`
+}
+
+type xrdsService struct {
+	Priority int      `xml:"priority,attr"`
+	Types    []string `xml:"Type"`
+	URIs     []string `xml:"URI"`
+	LocalID  string   `xml:"LocalID,omitempty"`
+}
+
+// marshalXRDS encodes an XRDS document containing the given services.
+func marshalXRDS(services []xrdsService) ([]byte, error) {
+	doc, err := xml.MarshalIndent(xrds{XRD: xrd{Services: services}}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), doc...), nil
+}
@@ -0,0 +1,86 @@
+package openid2
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// parseXRDS parses the services in an XRDS document.
+func parseXRDS(t *testing.T, body []byte) []xrdsService {
+	t.Helper()
+	var doc xrds
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("cannot parse XRDS %q: %s", body, err)
+	}
+	return doc.XRD.Services
+}
+
+func TestXRDSHandler(t *testing.T) {
+	x := &XRDSHandler{
+		Endpoint:   testEndpoint,
+		Server:     true,
+		Signon:     true,
+		LocalID:    testID,
+		Extensions: []string{sreg11Namespace},
+	}
+	rec := httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest("GET", "https://op.example.com/xrds", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/xrds+xml" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	expect := []xrdsService{{
+		Priority: 0,
+		Types:    []string{ServerType, sreg11Namespace},
+		URIs:     []string{testEndpoint},
+	}, {
+		Priority: 10,
+		Types:    []string{SignonType, sreg11Namespace},
+		URIs:     []string{testEndpoint},
+		LocalID:  testID,
+	}}
+	if services := parseXRDS(t, rec.Body.Bytes()); !reflect.DeepEqual(services, expect) {
+		t.Errorf("unexpected services %+v, expected %+v", services, expect)
+	}
+
+	x.Server = false
+	rec = httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest("GET", "https://op.example.com/xrds", nil))
+	if services := parseXRDS(t, rec.Body.Bytes()); !reflect.DeepEqual(services, expect[1:]) {
+		t.Errorf("unexpected services %+v, expected %+v", services, expect[1:])
+	}
+}
+
+func TestReturnToXRDS(t *testing.T) {
+	returnTo := []string{testReturnTo, "https://rp.example.com/other"}
+	doc, err := ReturnToXRDS(returnTo...)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expect := []xrdsService{{
+		Types: []string{ReturnToType},
+		URIs:  returnTo,
+	}}
+	if services := parseXRDS(t, doc); !reflect.DeepEqual(services, expect) {
+		t.Errorf("unexpected services %+v, expected %+v", services, expect)
+	}
+}
+
+func TestReturnToXRDSHandler(t *testing.T) {
+	x := &ReturnToXRDSHandler{
+		ReturnTo: []string{testReturnTo},
+	}
+	rec := httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest("GET", testRealm, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/xrds+xml" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	expect := []xrdsService{{
+		Types: []string{ReturnToType},
+		URIs:  []string{testReturnTo},
+	}}
+	if services := parseXRDS(t, rec.Body.Bytes()); !reflect.DeepEqual(services, expect) {
+		t.Errorf("unexpected services %+v, expected %+v", services, expect)
+	}
+}
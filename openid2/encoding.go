@@ -28,6 +28,36 @@ func EncodeHTTP(v url.Values, p map[string]string) {
 	}
 }
 
+// StripHTTP removes all openid parameters from v.
+func StripHTTP(v url.Values) {
+	for k := range v {
+		if strings.HasPrefix(k, "openid.") {
+			v.Del(k)
+		}
+	}
+}
+
+// stripRawQuery removes all openid parameters from the encoded query
+// string q. The remaining parameters are left exactly as they were
+// encoded.
+func stripRawQuery(q string) string {
+	if q == "" {
+		return ""
+	}
+	var kept []string
+	for _, part := range strings.Split(q, "&") {
+		k := part
+		if i := strings.Index(k, "="); i >= 0 {
+			k = k[:i]
+		}
+		if k, err := url.QueryUnescape(k); err == nil && strings.HasPrefix(k, "openid.") {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
 // ParseKeyValue
 func ParseKeyValue(body []byte) (map[string]string, error) {
 	p := make(map[string]string)
@@ -0,0 +1,95 @@
+package openid2
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStripHTTP(t *testing.T) {
+	v := url.Values{
+		"openid.mode":      {"id_res"},
+		"openid.sig":       {"stale"},
+		"state":            {"1"},
+		"openidish":        {"kept"},
+		"openid":           {"kept"},
+		"not.openid.value": {"kept"},
+	}
+	StripHTTP(v)
+	expect := url.Values{
+		"state":            {"1"},
+		"openidish":        {"kept"},
+		"openid":           {"kept"},
+		"not.openid.value": {"kept"},
+	}
+	if v.Encode() != expect.Encode() {
+		t.Errorf("unexpected values %q, expected %q", v.Encode(), expect.Encode())
+	}
+}
+
+func TestRedirectURLReplacesOpenIDResidue(t *testing.T) {
+	returnTo, err := url.Parse("https://rp.example.com/return?openid.mode=cancel&state=1&openid.sig=stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(redirectURL(returnTo, map[string]string{
+		"ns":   Namespace,
+		"mode": "id_res",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if len(q["openid.mode"]) != 1 || q.Get("openid.mode") != "id_res" {
+		t.Errorf("unexpected openid.mode %q", q["openid.mode"])
+	}
+	if _, ok := q["openid.sig"]; ok {
+		t.Errorf("stale openid.sig not removed from %q", u)
+	}
+	if q.Get("state") != "1" {
+		t.Errorf("return_to parameters not preserved in %q", u)
+	}
+}
+
+func TestRedirectURLPreservesEncodedReturnTo(t *testing.T) {
+	const query = "z=%2Fa%20b&a=x+y&next=%3Fq%3D1%26r%3D2&emoji=%E2%9C%93"
+	returnTo, err := url.Parse("https://rp.example.com/return?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := redirectURL(returnTo, map[string]string{
+		"ns":   Namespace,
+		"mode": "id_res",
+	})
+	if !strings.HasPrefix(loc, "https://rp.example.com/return?"+query+"&") {
+		t.Errorf("return_to query not preserved exactly in %q", loc)
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("openid.mode") != "id_res" {
+		t.Errorf("openid parameters not added to %q", loc)
+	}
+}
+
+func TestRedirectURLPreservesFragment(t *testing.T) {
+	returnTo, err := url.Parse("https://rp.example.com/return?state=1#section/2?x=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := redirectURL(returnTo, map[string]string{
+		"ns":   Namespace,
+		"mode": "id_res",
+	})
+	u, err := url.Parse(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Fragment != "section/2?x=y" {
+		t.Errorf("fragment not preserved in %q", loc)
+	}
+	if u.Query().Get("openid.mode") != "id_res" || u.Query().Get("state") != "1" {
+		t.Errorf("unexpected query in %q", loc)
+	}
+}
@@ -2,16 +2,113 @@ package openid2
 
 import (
 	"fmt"
+	"net/url"
+	"sort"
 	"strings"
 )
 
+const (
+	sreg10Namespace = "http://openid.net/sreg/1.0"
+	sreg11Namespace = "http://openid.net/extensions/sreg/1.1"
+	axNamespace     = "http://openid.net/srv/ax/1.0"
+	papeNamespace   = "http://specs.openid.net/extensions/pape/1.0"
+)
+
+// wellKnownNamespaces holds the namespaces of commonly used extensions.
+var wellKnownNamespaces = []string{
+	sreg10Namespace,
+	sreg11Namespace,
+	axNamespace,
+	papeNamespace,
+}
+
 type Extension struct {
 	Namespace string
 	Prefix    string
-	Params    map[string]string
+
+	// Params holds the extension parameters keyed by the parameter
+	// name without the extension prefix. Names may themselves
+	// contain dots, for example "value.email.1".
+	Params map[string]string
+
+	// Unsigned optionally holds the names of parameters that should
+	// not be included in the signature of a response.
+	Unsigned map[string]bool
+}
+
+// extensionPolicy holds the configurable rules applied to extensions
+// parsed from a request.
+type extensionPolicy struct {
+	// banned holds prefixes that are not allowed in addition to those
+	// banned by the specification. A pattern ending in "*" bans every
+	// prefix starting with the rest of the pattern.
+	banned []string
+
+	// supported holds the namespaces of the extensions that will be
+	// parsed. If supported is nil all extensions are parsed.
+	supported []string
+
+	// mergeDuplicates causes the parameters of a namespace declared
+	// with more than one prefix to be merged into a single
+	// extension, rather than rejecting the request.
+	mergeDuplicates bool
+
+	// strictNamespaces causes requests containing extension
+	// namespaces that are not absolute URIs to be rejected.
+	strictNamespaces bool
+}
+
+// bannedPrefix reports whether the given prefix may not be used by an
+// extension.
+func (p extensionPolicy) bannedPrefix(prefix string) bool {
+	if bannedPrefixes[prefix] {
+		return true
+	}
+	for _, b := range p.banned {
+		if strings.HasSuffix(b, "*") {
+			if strings.HasPrefix(prefix, strings.TrimSuffix(b, "*")) {
+				return true
+			}
+			continue
+		}
+		if prefix == b {
+			return true
+		}
+	}
+	return false
+}
+
+// supports reports whether extensions with the given namespace should
+// be parsed.
+func (p extensionPolicy) supports(ns string) bool {
+	if p.supported == nil {
+		return true
+	}
+	for _, s := range p.supported {
+		if s == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNamespace checks that ns is an absolute URI. If ns appears
+// to be a malformed version of a well-known extension namespace the
+// error says so.
+func validateNamespace(ns string) error {
+	for _, wkns := range wellKnownNamespaces {
+		if ns != wkns && strings.TrimSuffix(strings.TrimSpace(ns), "/") == wkns {
+			return fmt.Errorf("invalid extension namespace %q, expected %q", ns, wkns)
+		}
+	}
+	u, err := url.Parse(ns)
+	if err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid extension namespace %q: must be an absolute URI", ns)
+	}
+	return nil
 }
 
-func parseExtensions(params map[string]string) ([]Extension, error) {
+func parseExtensions(params map[string]string, policy extensionPolicy) ([]Extension, error) {
 	prefixes := make(map[string]string)
 	namespaces := make(map[string]string)
 	for k, v := range params {
@@ -23,30 +120,55 @@ func parseExtensions(params map[string]string) ([]Extension, error) {
 			continue
 		}
 		prefix := parts[1]
-		if bannedPrefixes[prefix] {
+		if policy.bannedPrefix(prefix) {
 			return nil, fmt.Errorf("namespace prefix %q not allowed", prefix)
 		}
 		if ns, ok := prefixes[prefix]; ok && ns != v {
 			return nil, fmt.Errorf("namespace prefix %q assigned to multiple namespaces", prefix)
 		}
 		ns := v
+		if policy.strictNamespaces {
+			if err := validateNamespace(ns); err != nil {
+				return nil, err
+			}
+		}
+		prefixes[prefix] = ns
 		if p, ok := namespaces[ns]; ok && p != prefix {
-			return nil, fmt.Errorf("namespace %q assigned to multiple prefixes", ns)
+			if !policy.mergeDuplicates {
+				return nil, fmt.Errorf("namespace %q assigned to multiple prefixes", ns)
+			}
+			// Use the lowest prefix so that the result is
+			// deterministic.
+			if p < prefix {
+				continue
+			}
 		}
 		namespaces[ns] = prefix
-		prefixes[prefix] = ns
 	}
-	extensions := make([]Extension, len(prefixes))
+	var extensions []Extension
 	positions := make(map[string]int)
-	i := 0
-	for p, ns := range prefixes {
-		extensions[i] = Extension{
+	for ns, p := range namespaces {
+		if !policy.supports(ns) {
+			continue
+		}
+		positions[p] = len(extensions)
+		extensions = append(extensions, Extension{
 			Namespace: ns,
 			Prefix:    p,
 			Params:    map[string]string{},
+		})
+	}
+	for p, ns := range prefixes {
+		if pos, ok := positions[namespaces[ns]]; ok {
+			positions[p] = pos
 		}
-		positions[p] = i
-		i++
+	}
+	// from records the prefix each parameter value was taken from.
+	// Where merged prefixes both set a parameter the value from the
+	// lowest prefix is used, so that the result is deterministic.
+	from := make([]map[string]string, len(extensions))
+	for i := range from {
+		from[i] = make(map[string]string)
 	}
 	for k, v := range params {
 		parts := strings.SplitN(k, ".", 2)
@@ -62,31 +184,202 @@ func parseExtensions(params map[string]string) ([]Extension, error) {
 		if !ok {
 			continue
 		}
+		if p, ok := from[pos][key]; ok && p < prefix {
+			continue
+		}
+		from[pos][key] = prefix
 		extensions[pos].Params[key] = v
 	}
+	sort.Slice(extensions, func(i, j int) bool {
+		return extensions[i].Prefix < extensions[j].Prefix
+	})
 	return extensions, nil
 }
 
+// encodeExtensions adds the parameters for the given extensions to
+// params and returns the keys that should be signed. Each namespace is
+// assigned a single prefix; where an extension's preferred prefix
+// cannot be used a prefix of the form extN is assigned instead.
+// Extensions are encoded in order and their parameters in key order,
+// so the same input always produces the same signed list.
 func encodeExtensions(params map[string]string, extensions []Extension) (signed []string) {
 	var i int
 	used := map[string]bool{}
+	prefixes := map[string]string{}
 	for _, ext := range extensions {
-		prefix := ext.Prefix
-		for bannedPrefixes[prefix] || used[prefix] {
-			prefix = fmt.Sprintf("ext%d", i)
-			i++
+		prefix, ok := prefixes[ext.Namespace]
+		if !ok {
+			prefix = ext.Prefix
+			for prefix == "" || strings.Contains(prefix, ".") || bannedPrefixes[prefix] || used[prefix] {
+				prefix = fmt.Sprintf("ext%d", i)
+				i++
+			}
+			used[prefix] = true
+			prefixes[ext.Namespace] = prefix
+			params["ns."+prefix] = ext.Namespace
 		}
-		used[prefix] = true
-		params["ns."+prefix] = ext.Namespace
-		for k, v := range ext.Params {
+		keys := make([]string, 0, len(ext.Params))
+		for k := range ext.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := ext.Params[k]
 			key := fmt.Sprintf("%s.%s", prefix, k)
+			if _, ok := params[key]; !ok && !ext.Unsigned[k] {
+				signed = append(signed, key)
+			}
 			params[key] = v
-			signed = append(signed, key)
 		}
 	}
 	return
 }
 
+// filterExtensions returns the extensions that are in response to one
+// of the requested extensions. Simple registration responses are
+// further restricted to the fields that were requested, and attribute
+// exchange fetch responses to the attributes that were requested.
+func filterExtensions(requested, extensions []Extension) []Extension {
+	reqs := make(map[string]Extension)
+	for _, ext := range requested {
+		reqs[ext.Namespace] = ext
+	}
+	var filtered []Extension
+	for _, ext := range extensions {
+		req, ok := reqs[ext.Namespace]
+		if !ok {
+			continue
+		}
+		switch ext.Namespace {
+		case sreg10Namespace, sreg11Namespace:
+			ext = filterSRegFields(req, ext)
+		case axNamespace:
+			ext = filterAXAttributes(req, ext)
+		}
+		filtered = append(filtered, ext)
+	}
+	return filtered
+}
+
+// SRegResponse builds the simple registration response to req from
+// the user data in available, which is keyed by field name. Only
+// fields that are both requested and available are included; the
+// caller should remove any fields the user has not agreed to release
+// from available. SRegResponse returns false if req does not contain a
+// simple registration request.
+func SRegResponse(req *LoginRequest, available map[string]string) (Extension, bool) {
+	for _, ext := range req.Extensions {
+		switch ext.Namespace {
+		case sreg10Namespace, sreg11Namespace:
+			return filterSRegFields(ext, Extension{
+				Namespace: ext.Namespace,
+				Prefix:    "sreg",
+				Params:    available,
+			}), true
+		}
+	}
+	return Extension{}, false
+}
+
+// filterSRegFields returns ext restricted to the fields listed as
+// required or optional in the simple registration request req.
+func filterSRegFields(req, ext Extension) Extension {
+	fields := make(map[string]bool)
+	for _, k := range []string{"required", "optional"} {
+		for _, f := range strings.Split(req.Params[k], ",") {
+			fields[strings.TrimSpace(f)] = true
+		}
+	}
+	params := make(map[string]string)
+	for k, v := range ext.Params {
+		if fields[k] {
+			params[k] = v
+		}
+	}
+	ext.Params = params
+	return ext
+}
+
+// filterAXAttributes returns the attribute exchange fetch response ext
+// restricted to the attributes requested, as required or if available,
+// in the fetch request req. Attributes are matched by type URI, as the
+// response may use different aliases to the request. Other attribute
+// exchange messages are returned unchanged.
+func filterAXAttributes(req, ext Extension) Extension {
+	if req.Params["mode"] != "fetch_request" || ext.Params["mode"] != "fetch_response" {
+		return ext
+	}
+	types := make(map[string]bool)
+	for _, k := range []string{"required", "if_available"} {
+		for _, alias := range strings.Split(req.Params[k], ",") {
+			if uri := req.Params["type."+strings.TrimSpace(alias)]; uri != "" {
+				types[uri] = true
+			}
+		}
+	}
+	params := map[string]string{
+		"mode": ext.Params["mode"],
+	}
+	if req.Params["update_url"] != "" && ext.Params["update_url"] != "" {
+		params["update_url"] = ext.Params["update_url"]
+	}
+	for k, v := range ext.Params {
+		parts := strings.SplitN(k, ".", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		switch parts[0] {
+		case "type", "count", "value":
+			if types[ext.Params["type."+parts[1]]] {
+				params[k] = v
+			}
+		}
+	}
+	ext.Params = params
+	return ext
+}
+
+// approvedExtensions returns the extensions restricted to their mode
+// and the parameters approved for their namespace in approved.
+func approvedExtensions(approved map[string][]string, extensions []Extension) []Extension {
+	var filtered []Extension
+	for _, ext := range extensions {
+		params := make(map[string]string)
+		for k, v := range ext.Params {
+			if k == "mode" || approvedParam(ext.Namespace, approved[ext.Namespace], k) {
+				params[k] = v
+			}
+		}
+		ext.Params = params
+		filtered = append(filtered, ext)
+	}
+	return filtered
+}
+
+// approvedParam reports whether the parameter key of an extension with
+// namespace ns is one of the approved names. Attribute exchange
+// attributes are approved by alias, so that an attribute's type, count
+// and values are approved together.
+func approvedParam(ns string, approved []string, key string) bool {
+	for _, name := range approved {
+		if key == name {
+			return true
+		}
+		if ns != axNamespace {
+			continue
+		}
+		parts := strings.SplitN(key, ".", 3)
+		if len(parts) < 2 || parts[1] != name {
+			continue
+		}
+		switch parts[0] {
+		case "type", "count", "value":
+			return true
+		}
+	}
+	return false
+}
+
 var bannedPrefixes = map[string]bool{
 	"assoc_handle":       true,
 	"assoc_type":         true,
@@ -0,0 +1,433 @@
+package openid2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBannedPrefixPatterns(t *testing.T) {
+	policy := extensionPolicy{
+		banned: []string{"internal_*", "legacy"},
+	}
+	tests := []struct {
+		prefix string
+		banned bool
+	}{
+		{"internal_", true},
+		{"internal_audit", true},
+		{"internal", false},
+		{"legacy", true},
+		{"legacy2", false},
+		{"sreg", false},
+		// Prefixes banned by the specification are always banned.
+		{"mode", true},
+		{"assoc_handle", true},
+	}
+	for _, test := range tests {
+		if banned := policy.bannedPrefix(test.prefix); banned != test.banned {
+			t.Errorf("bannedPrefix(%q) = %v, expected %v", test.prefix, banned, test.banned)
+		}
+	}
+}
+
+func TestBannedPrefixPatternRejectsRequest(t *testing.T) {
+	policy := extensionPolicy{
+		banned: []string{"internal_*"},
+	}
+	_, err := parseExtensions(map[string]string{
+		"ns.internal_x":    "http://example.com/ext",
+		"internal_x.value": "1",
+	}, policy)
+	if err == nil || err.Error() != `namespace prefix "internal_x" not allowed` {
+		t.Errorf("unexpected error %v", err)
+	}
+	exts, err := parseExtensions(map[string]string{
+		"ns.external": "http://example.com/ext",
+		"external.v":  "1",
+	}, policy)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(exts) != 1 || exts[0].Params["v"] != "1" {
+		t.Errorf("unexpected extensions %#v", exts)
+	}
+}
+
+func TestSpecBannedPrefixesCannotBeAllowed(t *testing.T) {
+	h := newTestHandler(approve())
+	h.BannedPrefixes = []string{}
+	h.TrustedReturnTo = func(string) bool { return true }
+	p := checkid(t, h, map[string]string{
+		"ns.mode": "http://example.com/ext",
+	})
+	if p["mode"] != "error" {
+		t.Errorf("unexpected mode %q, expected %q", p["mode"], "error")
+	}
+}
+
+func TestFilterExtensions(t *testing.T) {
+	h := newTestHandler(approve(Extension{
+		Namespace: sreg11Namespace,
+		Prefix:    "sreg",
+		Params: map[string]string{
+			"email":    "alice@example.com",
+			"nickname": "alice",
+			"dob":      "1970-01-01",
+		},
+	}, Extension{
+		Namespace: axNamespace,
+		Prefix:    "ax",
+		Params: map[string]string{
+			"mode":          "fetch_response",
+			"type.mail":     "http://axschema.org/contact/email",
+			"value.mail":    "alice@example.com",
+			"type.nick":     "http://axschema.org/namePerson/friendly",
+			"value.nick":    "alice",
+			"type.lang":     "http://axschema.org/pref/language",
+			"count.lang":    "2",
+			"value.lang.1":  "en",
+			"value.lang.2":  "fr",
+			"type.phone":    "http://axschema.org/contact/phone/default",
+			"value.phone":   "555-0100",
+			"update_url":    "https://rp.example.com/update",
+			"unknown.field": "x",
+		},
+	}, Extension{
+		Namespace: papeNamespace,
+		Prefix:    "pape",
+		Params: map[string]string{
+			"auth_policies": "none",
+		},
+	}))
+	p := checkid(t, h, map[string]string{
+		"ns.sreg":          sreg11Namespace,
+		"sreg.required":    "email",
+		"sreg.optional":    "fullname",
+		"ns.ax":            axNamespace,
+		"ax.mode":          "fetch_request",
+		"ax.type.email":    "http://axschema.org/contact/email",
+		"ax.type.language": "http://axschema.org/pref/language",
+		"ax.type.country":  "http://axschema.org/contact/country/home",
+		"ax.required":      "email",
+		"ax.if_available":  "language,country",
+	})
+	if p["mode"] != "id_res" {
+		t.Fatalf("unexpected mode %q", p["mode"])
+	}
+	exts, err := parseExtensions(p, extensionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]map[string]string)
+	for _, ext := range exts {
+		got[ext.Namespace] = ext.Params
+	}
+	expect := map[string]map[string]string{
+		sreg11Namespace: {
+			"email": "alice@example.com",
+		},
+		axNamespace: {
+			"mode":         "fetch_response",
+			"type.mail":    "http://axschema.org/contact/email",
+			"value.mail":   "alice@example.com",
+			"type.lang":    "http://axschema.org/pref/language",
+			"count.lang":   "2",
+			"value.lang.1": "en",
+			"value.lang.2": "fr",
+		},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("unexpected extensions in response\ngot    %v\nexpect %v", got, expect)
+	}
+}
+
+func TestEncodeExtensionsConflictingPrefixes(t *testing.T) {
+	exts := []Extension{{
+		Namespace: "http://example.com/ext/a",
+		Prefix:    "ext",
+		Params:    map[string]string{"a": "1"},
+	}, {
+		Namespace: "http://example.com/ext/b",
+		Prefix:    "ext",
+		Params:    map[string]string{"b": "2"},
+	}, {
+		Namespace: "http://example.com/ext/c",
+		Prefix:    "ext0",
+		Params:    map[string]string{"c": "3"},
+	}, {
+		Namespace: "http://example.com/ext/d",
+		Prefix:    "mode",
+		Params:    map[string]string{"d": "4"},
+	}}
+	params := make(map[string]string)
+	signed := encodeExtensions(params, exts)
+	if len(signed) != len(exts) {
+		t.Errorf("unexpected signed fields %v", signed)
+	}
+	var declared int
+	for k := range params {
+		if strings.HasPrefix(k, "ns.") {
+			declared++
+		}
+	}
+	if declared != len(exts) {
+		t.Errorf("unexpected namespace declarations in %v", params)
+	}
+	if _, ok := params["ns.mode"]; ok {
+		t.Errorf("banned prefix used in %v", params)
+	}
+
+	parsed, err := parseExtensions(params, extensionPolicy{})
+	if err != nil {
+		t.Fatalf("cannot parse encoded extensions: %s", err)
+	}
+	got := make(map[string]map[string]string)
+	for _, ext := range parsed {
+		got[ext.Namespace] = ext.Params
+	}
+	expect := make(map[string]map[string]string)
+	for _, ext := range exts {
+		expect[ext.Namespace] = ext.Params
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("extensions did not round trip\ngot    %v\nexpect %v", got, expect)
+	}
+
+}
+
+func TestEncodeExtensionsMergesNamespace(t *testing.T) {
+	params := make(map[string]string)
+	encodeExtensions(params, []Extension{{
+		Namespace: sreg11Namespace,
+		Prefix:    "sreg",
+		Params:    map[string]string{"email": "alice@example.com"},
+	}, {
+		Namespace: sreg11Namespace,
+		Prefix:    "sreg2",
+		Params:    map[string]string{"nickname": "alice"},
+	}})
+	expect := map[string]string{
+		"ns.sreg":       sreg11Namespace,
+		"sreg.email":    "alice@example.com",
+		"sreg.nickname": "alice",
+	}
+	if !reflect.DeepEqual(params, expect) {
+		t.Errorf("unexpected params %v, expected %v", params, expect)
+	}
+}
+
+func TestParseExtensionsMultiSegmentKeys(t *testing.T) {
+	exts, err := parseExtensions(map[string]string{
+		"mode":               "checkid_setup",
+		"ns.ax":              axNamespace,
+		"ax.mode":            "fetch_response",
+		"ax.type.email":      "http://axschema.org/contact/email",
+		"ax.count.email":     "2",
+		"ax.value.email.1":   "alice@example.com",
+		"ax.value.email.2":   "alice@example.org",
+		"ax.value.a.b.c.d.1": "deep",
+	}, extensionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exts) != 1 {
+		t.Fatalf("unexpected extensions %v", exts)
+	}
+	expect := map[string]string{
+		"mode":            "fetch_response",
+		"type.email":      "http://axschema.org/contact/email",
+		"count.email":     "2",
+		"value.email.1":   "alice@example.com",
+		"value.email.2":   "alice@example.org",
+		"value.a.b.c.d.1": "deep",
+	}
+	if !reflect.DeepEqual(exts[0].Params, expect) {
+		t.Errorf("unexpected params %v, expected %v", exts[0].Params, expect)
+	}
+
+	params := map[string]string{}
+	encodeExtensions(params, exts)
+	for k, v := range expect {
+		if params["ax."+k] != v {
+			t.Errorf("ax.%s encoded as %q, expected %q", k, params["ax."+k], v)
+		}
+	}
+}
+
+func TestSRegResponse(t *testing.T) {
+	req := &LoginRequest{Extensions: []Extension{{
+		Namespace: sreg11Namespace,
+		Prefix:    "sreg",
+		Params: map[string]string{
+			"required": "email",
+			"optional": "nickname",
+		},
+	}}}
+	ext, ok := SRegResponse(req, map[string]string{
+		"email":    "alice@example.com",
+		"fullname": "Alice Example",
+	})
+	if !ok {
+		t.Fatal("no simple registration response")
+	}
+	if ext.Namespace != sreg11Namespace {
+		t.Errorf("unexpected namespace %q", ext.Namespace)
+	}
+	expect := map[string]string{"email": "alice@example.com"}
+	if !reflect.DeepEqual(ext.Params, expect) {
+		t.Errorf("unexpected params %v, expected %v", ext.Params, expect)
+	}
+
+	if _, ok := SRegResponse(&LoginRequest{}, map[string]string{"email": "alice@example.com"}); ok {
+		t.Error("simple registration response to request without one")
+	}
+}
+
+func TestEncodeExtensionsUnsigned(t *testing.T) {
+	params := map[string]string{}
+	signed := encodeExtensions(params, []Extension{{
+		Namespace: "http://example.com/ext",
+		Prefix:    "ext",
+		Params: map[string]string{
+			"stable":   "a",
+			"volatile": "b",
+		},
+		Unsigned: map[string]bool{"volatile": true},
+	}})
+	if params["ext.volatile"] != "b" || params["ext.stable"] != "a" {
+		t.Errorf("extension parameters not encoded: %v", params)
+	}
+	expect := []string{"ext.stable"}
+	if !reflect.DeepEqual(signed, expect) {
+		t.Errorf("unexpected signed fields %q, expected %q", signed, expect)
+	}
+}
+
+func TestParseExtensionsDuplicateNamespace(t *testing.T) {
+	params := map[string]string{
+		"ns.sreg":        sreg11Namespace,
+		"sreg.required":  "email",
+		"sreg.optional":  "fullname",
+		"ns.sreg2":       sreg11Namespace,
+		"sreg2.required": "nickname",
+		"sreg2.policy":   "https://rp.example.com/policy",
+		"ns.a":           sreg11Namespace,
+		"a.optional":     "dob",
+	}
+	if _, err := parseExtensions(params, extensionPolicy{}); err == nil || !strings.Contains(err.Error(), "assigned to multiple prefixes") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expect := []Extension{{
+		Namespace: sreg11Namespace,
+		Prefix:    "a",
+		Params: map[string]string{
+			"required": "email",
+			"optional": "dob",
+			"policy":   "https://rp.example.com/policy",
+		},
+	}}
+	// Map iteration order varies, so parse repeatedly to check the
+	// merge is deterministic.
+	for i := 0; i < 50; i++ {
+		exts, err := parseExtensions(params, extensionPolicy{mergeDuplicates: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exts, expect) {
+			t.Fatalf("unexpected extensions %v, expected %v", exts, expect)
+		}
+	}
+}
+
+func TestValidateNamespace(t *testing.T) {
+	tests := []struct {
+		ns          string
+		expectError string
+	}{{
+		ns: sreg11Namespace,
+	}, {
+		ns: "http://example.com/ext",
+	}, {
+		ns: "urn:example:ext",
+	}, {
+		ns:          sreg11Namespace + "/",
+		expectError: `invalid extension namespace "http://openid.net/extensions/sreg/1.1/", expected "http://openid.net/extensions/sreg/1.1"`,
+	}, {
+		ns:          " " + axNamespace,
+		expectError: `invalid extension namespace " http://openid.net/srv/ax/1.0", expected "http://openid.net/srv/ax/1.0"`,
+	}, {
+		ns:          "not a namespace",
+		expectError: `invalid extension namespace "not a namespace": must be an absolute URI`,
+	}, {
+		ns:          "/relative/ext",
+		expectError: `invalid extension namespace "/relative/ext": must be an absolute URI`,
+	}, {
+		ns:          "",
+		expectError: `invalid extension namespace "": must be an absolute URI`,
+	}}
+	for _, test := range tests {
+		err := validateNamespace(test.ns)
+		if test.expectError == "" {
+			if err != nil {
+				t.Errorf("validateNamespace(%q): unexpected error %s", test.ns, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expectError {
+			t.Errorf("validateNamespace(%q): unexpected error %v, expected %q", test.ns, err, test.expectError)
+		}
+	}
+}
+
+func TestParseExtensionsStrictNamespaces(t *testing.T) {
+	params := map[string]string{
+		"ns.ext":    "not a namespace",
+		"ext.value": "1",
+	}
+	if _, err := parseExtensions(params, extensionPolicy{strictNamespaces: true}); err == nil {
+		t.Error("expected error parsing malformed namespace")
+	}
+	exts, err := parseExtensions(params, extensionPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(exts) != 1 || exts[0].Namespace != "not a namespace" || exts[0].Params["value"] != "1" {
+		t.Errorf("unexpected extensions %#v", exts)
+	}
+}
+
+func TestEncodeExtensionsDeterministic(t *testing.T) {
+	extensions := []Extension{{
+		Namespace: axNamespace,
+		Prefix:    "ax",
+		Params: map[string]string{
+			"mode":         "fetch_response",
+			"type.email":   "http://axschema.org/contact/email",
+			"value.email":  "alice@example.com",
+			"type.name":    "http://axschema.org/namePerson",
+			"value.name":   "Alice",
+			"count.emails": "1",
+		},
+	}, {
+		Namespace: sreg11Namespace,
+		Prefix:    "ax",
+		Params: map[string]string{
+			"nickname": "alice",
+			"email":    "alice@example.com",
+			"fullname": "Alice",
+		},
+	}}
+	expectParams := make(map[string]string)
+	expectSigned := encodeExtensions(expectParams, extensions)
+	for i := 0; i < 20; i++ {
+		params := make(map[string]string)
+		signed := encodeExtensions(params, extensions)
+		if !reflect.DeepEqual(signed, expectSigned) {
+			t.Fatalf("signed list changed between calls: %v, expected %v", signed, expectSigned)
+		}
+		if !reflect.DeepEqual(params, expectParams) {
+			t.Fatalf("params changed between calls: %v, expected %v", params, expectParams)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package openid2
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// A Generator generates the unique values used by a Handler.
+type Generator interface {
+	// Handle generates a new association handle. The handler's
+	// HandlePrefix is prepended to the result and, for derived
+	// associations, the expiry time is also embedded in the handle.
+	Handle() (string, error)
+
+	// Nonce generates the unique part of a new response nonce. The
+	// handler prepends the current time to the result. If the
+	// handler has a NonceStore it is still used to ensure that each
+	// nonce is unique.
+	Nonce() (string, error)
+}
+
+// generator returns the Generator used by the handler.
+func (h *Handler) generator() Generator {
+	if h.Generator != nil {
+		return h.Generator
+	}
+	return randomGenerator{h}
+}
+
+// randomGenerator is the default Generator, it produces values from
+// random bytes as configured by the handler's HandleEncoding and
+// NonceLength.
+type randomGenerator struct {
+	h *Handler
+}
+
+// Handle implements Generator.Handle.
+func (g randomGenerator) Handle() (string, error) {
+	encode := g.h.HandleEncoding
+	if encode == nil {
+		encode = base64.RawURLEncoding.EncodeToString
+	}
+	var handle [16]byte
+	if _, err := rand.Read(handle[:]); err != nil {
+		return "", err
+	}
+	return encode(handle[:]), nil
+}
+
+// Nonce implements Generator.Nonce.
+func (g randomGenerator) Nonce() (string, error) {
+	n := g.h.NonceLength
+	if n == 0 {
+		n = defaultNonceLength
+	}
+	if n < 0 || n > maxNonceLength {
+		return "", fmt.Errorf("invalid nonce length %d", n)
+	}
+	nonce := make([]byte, n)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// validGenerated checks that a value produced by a Generator is
+// non-empty and only contains printable ASCII characters other than
+// space, as required of both association handles and response nonces.
+func validGenerated(kind, v string) error {
+	if v == "" {
+		return fmt.Errorf("invalid generated %s: empty", kind)
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < 33 || v[i] > 126 {
+			return fmt.Errorf("invalid generated %s %q", kind, v)
+		}
+	}
+	return nil
+}
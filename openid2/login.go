@@ -1,9 +1,12 @@
 package openid2
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 )
 
@@ -16,40 +19,100 @@ type LoginRequest struct {
 	ReturnTo   string
 	Realm      string
 	Extensions []Extension
+
+	// Params holds all of the openid parameters in the request.
+	Params Params
 }
 
-func parseLoginRequest(params map[string]string) (*LoginRequest, error) {
-	extensions, err := parseExtensions(params)
+func parseLoginRequest(params map[string]string, policy extensionPolicy) (*LoginRequest, error) {
+	extensions, err := parseExtensions(params, policy)
 	if err != nil {
 		return nil, err
 	}
+	if params["return_to"] != "" {
+		if _, err := parseReturnTo(params["return_to"]); err != nil {
+			return nil, err
+		}
+	}
+	if params["realm"] != "" {
+		if err := ValidateRealm(params["realm"]); err != nil {
+			return nil, err
+		}
+		if params["return_to"] != "" {
+			if err := ValidateRealmReturnTo(params["realm"], params["return_to"]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// If the realm is omitted the return_to URL is used as the
+	// realm.
+	realm := params["realm"]
+	if realm == "" {
+		realm = params["return_to"]
+	}
 	req := &LoginRequest{
 		ClaimedID:  params["claimed_id"],
 		Identity:   params["identity"],
 		ReturnTo:   params["return_to"],
-		Realm:      params["realm"],
+		Realm:      realm,
 		Extensions: extensions,
+		Params:     params,
 	}
 	return req, nil
 }
 
+// parseReturnTo parses returnTo, which must be an absolute http or
+// https URL.
+func parseReturnTo(returnTo string) (*url.URL, error) {
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid return_to %q: %s", returnTo, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid return_to %q: must be an http or https URL", returnTo)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid return_to %q: must be an absolute URL", returnTo)
+	}
+	return u, nil
+}
+
 // LoginResponse represents the response to an openid login request.
 type LoginResponse struct {
 	ClaimedID  string
 	Identity   string
 	OPEndpoint string
 	Extensions []Extension
+
+	// Approved optionally records the extension data the user has
+	// consented to release. If Approved is not nil only the extension
+	// parameters listed against the extension's namespace, and the
+	// extension's mode, are included in the response. Attribute
+	// exchange attributes are listed by alias, which approves the
+	// attribute's type, count and values together; other extensions
+	// list parameter keys, such as simple registration field names.
+	// An extension with nothing approved is still returned, without
+	// any data, so the relying party sees that nothing was released.
+	Approved map[string][]string
 }
 
 // LoginHandler provides server-side handling of a LoginRequest.
+//
+// Login is always called with the *http.Request received by the
+// Handler. For checkid_immediate requests the http.ResponseWriter is
+// nil, as the user may not be interacted with.
 type LoginHandler interface {
 	Login(http.ResponseWriter, *http.Request, *LoginRequest) (*LoginResponse, error)
 }
 
 func (h *Handler) login(w http.ResponseWriter, r *http.Request, params map[string]string) {
-	req, err := parseLoginRequest(params)
+	if isEndpoint(r, params["return_to"]) {
+		h.direct(w, r).respond(nil, fmt.Errorf("return_to %q refers to the OP endpoint", params["return_to"]))
+		return
+	}
+	req, err := parseLoginRequest(params, h.extensionPolicy())
 	if err != nil {
-		indirect(w, params["return_to"]).respond(nil, err)
+		h.indirect(w, r, params["return_to"]).respond(nil, err)
 		return
 	}
 	var resp *LoginResponse
@@ -59,13 +122,13 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request, params map[strin
 			resp, err = h.Login.Login(nil, r, req)
 		}
 		if err != nil && err != ErrUnauthenticated {
-			indirect(w, params["return_to"]).respond(nil, err)
+			h.indirect(w, r, params["return_to"]).respond(nil, err)
 			return
 		}
 		if resp != nil {
 			break
 		}
-		indirect(w, params["return_to"]).respond(map[string]string{
+		h.indirect(w, r, params["return_to"]).respond(map[string]string{
 			"ns":   Namespace,
 			"mode": "setup_needed",
 		}, nil)
@@ -75,7 +138,7 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request, params map[strin
 			resp, err = h.Login.Login(w, r, req)
 		}
 		if err != nil && err != ErrUnauthenticated {
-			indirect(w, params["return_to"]).respond(nil, err)
+			h.indirect(w, r, params["return_to"]).respond(nil, err)
 			return
 		}
 		if resp != nil {
@@ -84,61 +147,206 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request, params map[strin
 		if err == nil {
 			return
 		}
-		indirect(w, params["return_to"]).respond(map[string]string{
+		h.indirect(w, r, params["return_to"]).respond(map[string]string{
 			"ns":   Namespace,
 			"mode": "cancel",
 		}, nil)
 		return
 	default:
-		panic(fmt.Sprintf("login called with unexpected mode %q", params["mode"]))
+		h.direct(w, r).respond(nil, fmt.Errorf("unexpected mode %q", params["mode"]))
+		return
 	}
 	if params["return_to"] == "" {
-		direct(w).respond(nil, fmt.Errorf("cannot send id_res message, no return_to parameter"))
+		h.direct(w, r).respond(nil, fmt.Errorf("cannot send id_res message, no return_to parameter"))
 		return
 	}
-	nonce, err := h.getNonce()
-	if err != nil {
-		indirect(w, params["return_to"]).respond(nil, err)
+	opEndpoint := resp.OPEndpoint
+	if opEndpoint == "" {
+		opEndpoint, err = h.opEndpoint(r)
+		if err != nil {
+			h.indirect(w, r, params["return_to"]).respond(nil, err)
+			return
+		}
+	}
+	extensions := filterExtensions(req.Extensions, resp.Extensions)
+	if resp.Approved != nil {
+		extensions = approvedExtensions(resp.Approved, extensions)
+	}
+	rparams, signed, err := h.positiveAssertion(r.Context(), req, resp, opEndpoint, extensions)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		h.debugf("login request abandoned: %s", err)
 		return
 	}
-	assoc, err := h.getAssociation(params["assoc_handle"], nonce)
 	if err != nil {
-		indirect(w, params["return_to"]).respond(nil, err)
+		h.indirect(w, r, params["return_to"]).respond(nil, err)
 		return
 	}
-	// encode the response
+	if h.OnAssertion != nil {
+		h.OnAssertion(req.Realm, resp.ClaimedID)
+	}
+	if h.OnSigned != nil {
+		h.OnSigned(req, signed)
+	}
+	h.indirect(w, r, params["return_to"]).respond(rparams, nil)
+}
+
+// positiveAssertion creates a signed positive assertion of the
+// identifiers in resp from the OP at opEndpoint in response to req. The
+// association is chosen by the handler's AssociationFor hook, if any;
+// otherwise the association named by the request's assoc_handle is
+// used if it is still valid. If the requested handle is not valid it
+// is invalidated.
+// The assertion and the list of signed fields are returned. If ctx is
+// cancelled before the assertion is signed its error is returned.
+func (h *Handler) positiveAssertion(ctx context.Context, req *LoginRequest, resp *LoginResponse, opEndpoint string, extensions []Extension) (map[string]string, []string, error) {
+	if err := validateOPEndpoint(opEndpoint, h.RequireHTTPS); err != nil {
+		return nil, nil, err
+	}
+	// The LoginHandler may have taken some time, don't use the
+	// stores if the request has since been cancelled.
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	nonce, err := h.getNonce(ctx, opEndpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestHandle := req.Params["assoc_handle"]
+	var assoc *Association
+	if h.AssociationFor != nil {
+		assoc, err = h.associationFor(req, opEndpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if assoc == nil {
+		assoc, err = h.getAssociation(ctx, opEndpoint, requestHandle, nonce, req.Realm)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	signed := []string{
 		"op_endpoint",
 		"return_to",
 		"response_nonce",
 		"assoc_handle",
 	}
-	rparams := map[string]string{
+	params := map[string]string{
 		"ns":             Namespace,
 		"mode":           "id_res",
-		"return_to":      params["return_to"],
-		"op_endpoint":    resp.OPEndpoint,
+		"return_to":      req.ReturnTo,
+		"op_endpoint":    opEndpoint,
 		"response_nonce": nonce,
-		"assoc_handle":   assoc.Handle,
+	}
+	if h.SignNamespace {
+		signed = append(signed, "ns")
 	}
 	if resp.ClaimedID != "" {
 		signed = append(signed, "claimed_id")
-		rparams["claimed_id"] = resp.ClaimedID
+		params["claimed_id"] = resp.ClaimedID
 	}
 	if resp.Identity != "" {
 		signed = append(signed, "identity")
-		rparams["identity"] = resp.Identity
+		params["identity"] = resp.Identity
+	}
+	if requestHandle != "" && requestHandle != assoc.Handle {
+		// The requested association may not have been used
+		// because another was chosen, only tell the relying
+		// party to discard it if it is no longer valid.
+		valid, err := h.validHandle(ctx, opEndpoint, requestHandle)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !valid {
+			params["invalidate_handle"] = requestHandle
+		}
 	}
-	if params["assoc_handle"] != "" && params["assoc_handle"] != assoc.Handle {
-		rparams["invalidate_handle"] = params["assoc_handle"]
+	signed = append(signed, encodeExtensions(params, extensions)...)
+	if h.LenientSignedOrder {
+		// Sign the fields in canonical order so that the assertion
+		// can still be verified if the signed list is reordered.
+		sort.Strings(signed)
 	}
-	signed = append(signed, encodeExtensions(rparams, resp.Extensions)...)
-	rparams["signed"] = strings.Join(signed, ",")
-	sig, err := assoc.sign(rparams, signed)
+	params, err = h.signResponse(assoc, params, signed)
 	if err != nil {
-		indirect(w, params["return_to"]).respond(nil, err)
-		return
+		return nil, nil, err
+	}
+	return params, signed, nil
+}
+
+// validateOPEndpoint checks that opEndpoint is an absolute URL. If
+// requireHTTPS is true it must also be an https URL.
+func validateOPEndpoint(opEndpoint string, requireHTTPS bool) error {
+	u, err := url.Parse(opEndpoint)
+	if err != nil {
+		return fmt.Errorf("invalid op_endpoint %q: %s", opEndpoint, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("invalid op_endpoint %q: must be an absolute URL", opEndpoint)
+	}
+	if requireHTTPS && u.Scheme != "https" {
+		return fmt.Errorf("invalid op_endpoint %q: must be an https URL", opEndpoint)
+	}
+	return nil
+}
+
+// BuildUnsolicitedAssertion creates a positive assertion that was not
+// requested by the relying party, for an OP initiating a login. The
+// assertion is signed with a new association and returned as the URL,
+// based on returnTo, that the user should be redirected to. The OP
+// endpoint is the handler's configured or detected OPEndpoint.
+func (h *Handler) BuildUnsolicitedAssertion(returnTo, claimedID, identity string, exts []Extension) (string, error) {
+	u, err := parseReturnTo(returnTo)
+	if err != nil {
+		return "", err
+	}
+	opEndpoint := h.OPEndpoint
+	if opEndpoint == "" {
+		h.mu.Lock()
+		opEndpoint = h.detectedEndpoint
+		h.mu.Unlock()
+	}
+	if opEndpoint == "" {
+		return "", errors.New("cannot build unsolicited assertion: OP endpoint not known")
+	}
+	req := &LoginRequest{
+		ClaimedID:  claimedID,
+		Identity:   identity,
+		ReturnTo:   returnTo,
+		Realm:      returnTo,
+		Extensions: exts,
+	}
+	resp := &LoginResponse{
+		ClaimedID: claimedID,
+		Identity:  identity,
+	}
+	params, signed, err := h.positiveAssertion(context.Background(), req, resp, opEndpoint, exts)
+	if err != nil {
+		return "", err
+	}
+	if h.OnAssertion != nil {
+		h.OnAssertion(req.Realm, claimedID)
+	}
+	if h.OnSigned != nil {
+		h.OnSigned(req, signed)
+	}
+	return redirectURL(u, params), nil
+}
+
+// signResponse returns a message containing fields, signed with assoc.
+// The assoc_handle, signed and sig fields are added to the message;
+// signed lists the fields covered by the signature, in order.
+func (h *Handler) signResponse(assoc *Association, fields map[string]string, signed []string) (map[string]string, error) {
+	params := make(map[string]string, len(fields)+3)
+	for k, v := range fields {
+		params[k] = v
+	}
+	params["assoc_handle"] = assoc.Handle
+	params["signed"] = strings.Join(signed, ",")
+	sig, err := assoc.sign(params, signed, h.SignatureLengths[assoc.Type])
+	if err != nil {
+		return nil, err
 	}
-	rparams["sig"] = sig
-	indirect(w, params["return_to"]).respond(rparams, nil)
+	params["sig"] = sig
+	return params, nil
 }
@@ -0,0 +1,929 @@
+package openid2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testReturnTo = "https://rp.example.com/return?state=1"
+	testRealm    = "https://rp.example.com/"
+	testID       = "https://op.example.com/id/alice"
+)
+
+// loginFunc implements LoginHandler by calling the function.
+type loginFunc func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error)
+
+func (f loginFunc) Login(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+	return f(w, r, req)
+}
+
+// approve returns a LoginHandler that authenticates every request as
+// testID, responding with the given extensions.
+func approve(exts ...Extension) LoginHandler {
+	return loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		return &LoginResponse{
+			ClaimedID:  testID,
+			Identity:   testID,
+			Extensions: exts,
+		}, nil
+	})
+}
+
+// newTestHandler creates a Handler for testEndpoint using login and a
+// new association store.
+func newTestHandler(login LoginHandler) *Handler {
+	return &Handler{
+		Login:        login,
+		Associations: NewMemoryAssociationStore(),
+		OPEndpoint:   testEndpoint,
+	}
+}
+
+// checkid makes a checkid_setup request to h, with any extra
+// parameters given, and returns the parameters sent back to the
+// relying party.
+func checkid(t *testing.T, h http.Handler, extra map[string]string) map[string]string {
+	t.Helper()
+	params := map[string]string{
+		"ns":         Namespace,
+		"mode":       "checkid_setup",
+		"claimed_id": "http://specs.openid.net/auth/2.0/identifier_select",
+		"identity":   "http://specs.openid.net/auth/2.0/identifier_select",
+		"return_to":  testReturnTo,
+		"realm":      testRealm,
+	}
+	for k, v := range extra {
+		params[k] = v
+	}
+	return redirectParams(t, serve(h, "GET", params))
+}
+
+// verify asks h to verify the assertion p using check_authentication
+// and returns the is_valid result.
+func verify(t *testing.T, h http.Handler, p map[string]string) string {
+	t.Helper()
+	params := make(map[string]string, len(p))
+	for k, v := range p {
+		params[k] = v
+	}
+	params["mode"] = "check_authentication"
+	return directParams(t, serve(h, "POST", params))["is_valid"]
+}
+
+func TestOnAssertion(t *testing.T) {
+	h := newTestHandler(approve())
+	var calls int
+	var realm, claimedID string
+	h.OnAssertion = func(r, id string) {
+		calls++
+		realm, claimedID = r, id
+	}
+	p := checkid(t, h, nil)
+	if p["mode"] != "id_res" {
+		t.Fatalf("unexpected mode %q", p["mode"])
+	}
+	if calls != 1 {
+		t.Fatalf("OnAssertion called %d times, expected 1", calls)
+	}
+	if realm != testRealm || claimedID != testID {
+		t.Errorf("OnAssertion called with (%q, %q), expected (%q, %q)", realm, claimedID, testRealm, testID)
+	}
+}
+
+func TestOnAssertionNotCalledOnCancel(t *testing.T) {
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		return nil, ErrUnauthenticated
+	}))
+	h.OnAssertion = func(string, string) {
+		t.Errorf("OnAssertion called for cancelled login")
+	}
+	if p := checkid(t, h, nil); p["mode"] != "cancel" {
+		t.Errorf("unexpected mode %q, expected %q", p["mode"], "cancel")
+	}
+}
+
+func TestReturnToOPEndpoint(t *testing.T) {
+	h := newTestHandler(approve())
+	h.TrustedReturnTo = func(string) bool { return true }
+	for _, returnTo := range []string{
+		testEndpoint,
+		testEndpoint + "/",
+		"http://OP.example.com/openid?x=1",
+	} {
+		rec := serve(h, "GET", map[string]string{
+			"ns":        Namespace,
+			"mode":      "checkid_setup",
+			"return_to": returnTo,
+		})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("return_to %q: unexpected status %d, expected %d", returnTo, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		p := directParams(t, rec)
+		if p["mode"] != "error" || !strings.Contains(p["error"], "refers to the OP endpoint") {
+			t.Errorf("return_to %q: unexpected response %v", returnTo, p)
+		}
+	}
+}
+
+func TestParseLoginRequestReturnTo(t *testing.T) {
+	tests := []struct {
+		returnTo string
+		err      string
+	}{{
+		returnTo: "https://rp.example.com/return",
+	}, {
+		returnTo: "http://rp.example.com/return?state=1",
+	}, {
+		returnTo: "/return",
+		err:      `invalid return_to "/return": must be an http or https URL`,
+	}, {
+		returnTo: "//rp.example.com/return",
+		err:      `invalid return_to "//rp.example.com/return": must be an http or https URL`,
+	}, {
+		returnTo: "javascript:alert(1)",
+		err:      `invalid return_to "javascript:alert(1)": must be an http or https URL`,
+	}, {
+		returnTo: "https:///return",
+		err:      `invalid return_to "https:///return": must be an absolute URL`,
+	}}
+	for _, test := range tests {
+		req, err := parseLoginRequest(map[string]string{
+			"return_to": test.returnTo,
+		}, extensionPolicy{})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("return_to %q: unexpected error %v, expected %q", test.returnTo, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("return_to %q: unexpected error %s", test.returnTo, err)
+			continue
+		}
+		if req.ReturnTo != test.returnTo {
+			t.Errorf("unexpected ReturnTo %q, expected %q", req.ReturnTo, test.returnTo)
+		}
+	}
+}
+
+// extensionParams returns the parameters of the extension with the
+// given namespace in the response p, and the alias it was sent with.
+func extensionParams(p map[string]string, ns string) (string, map[string]string) {
+	var alias string
+	for k, v := range p {
+		if strings.HasPrefix(k, "ns.") && v == ns {
+			alias = strings.TrimPrefix(k, "ns.")
+		}
+	}
+	if alias == "" {
+		return "", nil
+	}
+	params := make(map[string]string)
+	for k, v := range p {
+		if strings.HasPrefix(k, alias+".") {
+			params[strings.TrimPrefix(k, alias+".")] = v
+		}
+	}
+	return alias, params
+}
+
+func TestApprovedExtensions(t *testing.T) {
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		return &LoginResponse{
+			ClaimedID: testID,
+			Identity:  testID,
+			Extensions: []Extension{{
+				Namespace: sreg11Namespace,
+				Params: map[string]string{
+					"nickname": "alice",
+					"email":    "alice@example.com",
+				},
+			}},
+			Approved: map[string][]string{
+				sreg11Namespace: {"nickname"},
+			},
+		}, nil
+	}))
+	p := checkid(t, h, map[string]string{
+		"ns.sreg":       sreg11Namespace,
+		"sreg.required": "nickname,email",
+	})
+	alias, sreg := extensionParams(p, sreg11Namespace)
+	if sreg["nickname"] != "alice" {
+		t.Errorf("approved nickname not returned: %v", p)
+	}
+	if _, ok := sreg["email"]; ok {
+		t.Errorf("unapproved email returned: %v", p)
+	}
+	for _, k := range strings.Split(p["signed"], ",") {
+		if k == alias+".email" {
+			t.Errorf("unapproved email signed: %q", p["signed"])
+		}
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("assertion not verified: is_valid %q", v)
+	}
+}
+
+func TestLoginRequestAvailable(t *testing.T) {
+	for _, mode := range []string{"checkid_setup", "checkid_immediate"} {
+		var r *http.Request
+		var req *LoginRequest
+		h := newTestHandler(loginFunc(func(_ http.ResponseWriter, hr *http.Request, lr *LoginRequest) (*LoginResponse, error) {
+			r, req = hr, lr
+			return nil, ErrUnauthenticated
+		}))
+		params := map[string]string{
+			"ns":        Namespace,
+			"mode":      mode,
+			"return_to": testReturnTo,
+			"realm":     testRealm,
+		}
+		v := make(url.Values)
+		EncodeHTTP(v, params)
+		hr := httptest.NewRequest("GET", testEndpoint+"?"+v.Encode(), nil)
+		hr.Header.Set("User-Agent", "test-agent")
+		h.ServeHTTP(httptest.NewRecorder(), hr)
+		if r == nil {
+			t.Errorf("%s: no request passed to LoginHandler", mode)
+			continue
+		}
+		if r.UserAgent() != "test-agent" {
+			t.Errorf("%s: unexpected User-Agent %q", mode, r.UserAgent())
+		}
+		if req.Params["mode"] != mode || req.Params["return_to"] != testReturnTo {
+			t.Errorf("%s: unexpected params %v", mode, req.Params)
+		}
+	}
+}
+
+func TestSignResponse(t *testing.T) {
+	h := &Handler{SignatureLengths: map[string]int{hmacSHA1: 10}}
+	fields := map[string]string{
+		"ns":       Namespace,
+		"mode":     "id_res",
+		"identity": testID,
+		"unsigned": "value",
+	}
+	for _, assocType := range []string{hmacSHA256, hmacSHA1} {
+		assoc := &Association{Handle: "handle", Type: assocType, Secret: []byte("secret")}
+		p, err := h.signResponse(assoc, fields, []string{"mode", "identity"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["sig"]; ok {
+			t.Fatalf("fields modified: %v", fields)
+		}
+		if p["assoc_handle"] != "handle" || p["signed"] != "mode,identity" || p["unsigned"] != "value" {
+			t.Errorf("%s: unexpected response %v", assocType, p)
+		}
+		ok, err := VerifyAssertion(assoc, p, h.SignatureLengths[assocType])
+		if err != nil || !ok {
+			t.Errorf("%s: signature not verified: %v, %v", assocType, ok, err)
+		}
+		p["unsigned"] = "changed"
+		if ok, _ := VerifyAssertion(assoc, p, h.SignatureLengths[assocType]); !ok {
+			t.Errorf("%s: unsigned field covered by signature", assocType)
+		}
+		p["identity"] = "https://op.example.com/id/mallory"
+		if ok, _ := VerifyAssertion(assoc, p, h.SignatureLengths[assocType]); ok {
+			t.Errorf("%s: tampered response verified", assocType)
+		}
+	}
+}
+
+func TestSupportedExtensions(t *testing.T) {
+	var got []Extension
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		got = req.Extensions
+		return &LoginResponse{ClaimedID: testID, Identity: testID}, nil
+	}))
+	h.SupportedExtensions = []string{sreg11Namespace}
+	p := checkid(t, h, map[string]string{
+		"ns.sreg":       sreg11Namespace,
+		"sreg.required": "email",
+		"ns.ax":         axNamespace,
+		"ax.mode":       "fetch_request",
+		"ns.x":          "http://example.com/unknown",
+		"x.y":           "z",
+	})
+	if p["mode"] != "id_res" {
+		t.Fatalf("unexpected response %v", p)
+	}
+	if len(got) != 1 || got[0].Namespace != sreg11Namespace || got[0].Params["required"] != "email" {
+		t.Errorf("unexpected extensions passed to LoginHandler: %v", got)
+	}
+
+	h.SupportedExtensions = nil
+	checkid(t, h, map[string]string{
+		"ns.sreg": sreg11Namespace,
+		"ns.ax":   axNamespace,
+	})
+	if len(got) != 2 {
+		t.Errorf("unexpected extensions passed to LoginHandler: %v", got)
+	}
+}
+
+func TestImmediateMalformedExtension(t *testing.T) {
+	var called bool
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		called = true
+		return &LoginResponse{ClaimedID: testID, Identity: testID}, nil
+	}))
+	h.StrictNamespaces = true
+	h.TrustedReturnTo = func(string) bool { return true }
+	p := redirectParams(t, serve(h, "GET", map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_immediate",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+		"ns.sreg":   "not a namespace",
+	}))
+	if p["mode"] != "error" || !strings.Contains(p["error"], `invalid extension namespace "not a namespace"`) {
+		t.Errorf("unexpected response %v", p)
+	}
+	if called {
+		t.Error("LoginHandler called for malformed request")
+	}
+}
+
+func TestLoginUnexpectedMode(t *testing.T) {
+	h := newTestHandler(approve())
+	for _, mode := range []string{"", "checkid_bogus"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", testEndpoint, nil)
+		h.login(rec, req, map[string]string{
+			"ns":        Namespace,
+			"mode":      mode,
+			"return_to": testReturnTo,
+			"realm":     testRealm,
+		})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("mode %q: unexpected status %d", mode, rec.Code)
+		}
+		if p := directParams(t, rec); p["mode"] != "error" || p["error"] != fmt.Sprintf("unexpected mode %q", mode) {
+			t.Errorf("mode %q: unexpected response %v", mode, p)
+		}
+	}
+
+	rec := serve(h, "GET", map[string]string{
+		"ns":        Namespace,
+		"return_to": testReturnTo,
+	})
+	if p := directParams(t, rec); p["mode"] != "error" {
+		t.Errorf("request without mode: unexpected response %v", p)
+	}
+}
+
+// blockingStore is a ContextAssociationStore whose AddContext blocks
+// until the context is done.
+type blockingStore struct {
+	*MemoryAssociationStore
+	adding chan struct{}
+}
+
+func (s blockingStore) AddContext(ctx context.Context, a *Association) error {
+	close(s.adding)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s blockingStore) GetContext(ctx context.Context, endpoint, handle string) (*Association, error) {
+	return s.Get(endpoint, handle)
+}
+
+func (s blockingStore) DeleteContext(ctx context.Context, endpoint, handle string) error {
+	return s.Delete(endpoint, handle)
+}
+
+// checkidRequest creates a checkid_setup request to testEndpoint.
+func checkidRequest(ctx context.Context) *http.Request {
+	v := make(url.Values)
+	EncodeHTTP(v, map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+	})
+	return httptest.NewRequest("GET", testEndpoint+"?"+v.Encode(), nil).WithContext(ctx)
+}
+
+func TestLoginContextPassedToStore(t *testing.T) {
+	var buf bytes.Buffer
+	store := blockingStore{NewMemoryAssociationStore(), make(chan struct{})}
+	h := newTestHandler(approve())
+	h.Associations = store
+	h.Logger = log.New(&buf, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(rec, checkidRequest(ctx))
+	}()
+	<-store.adding
+	cancel()
+	<-done
+	if rec.Header().Get("Location") != "" || rec.Body.Len() != 0 {
+		t.Errorf("response sent to abandoned request: Location %q, body %q", rec.Header().Get("Location"), rec.Body.String())
+	}
+	if buf.Len() != 0 {
+		t.Errorf("abandoned request logged as a store error: %q", buf.String())
+	}
+}
+
+// countingStore counts the associations added to it.
+type countingStore struct {
+	*MemoryAssociationStore
+	adds int
+}
+
+func (s *countingStore) Add(a *Association) error {
+	s.adds++
+	return s.MemoryAssociationStore.Add(a)
+}
+
+func TestLoginCancelledBeforeStoresUsed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &countingStore{MemoryAssociationStore: NewMemoryAssociationStore()}
+	nonces := NewMemoryNonceStore(time.Hour)
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		// The user agent goes away while the user is logging in.
+		cancel()
+		return &LoginResponse{ClaimedID: testID, Identity: testID}, nil
+	}))
+	h.Associations = store
+	h.Nonces = nonces
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, checkidRequest(ctx))
+	if rec.Header().Get("Location") != "" {
+		t.Errorf("response sent to abandoned request: %q", rec.Header().Get("Location"))
+	}
+	if store.adds != 0 {
+		t.Errorf("%d associations added for abandoned request", store.adds)
+	}
+	if len(nonces.m) != 0 {
+		t.Errorf("nonces recorded for abandoned request: %v", nonces.m)
+	}
+}
+
+func TestRealmDefaultsToReturnTo(t *testing.T) {
+	req, err := parseLoginRequest(map[string]string{
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+	}, extensionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Realm != testReturnTo {
+		t.Errorf("unexpected realm %q, expected %q", req.Realm, testReturnTo)
+	}
+
+	req, err = parseLoginRequest(map[string]string{
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+	}, extensionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Realm != testRealm {
+		t.Errorf("unexpected realm %q, expected %q", req.Realm, testRealm)
+	}
+
+	h := newTestHandler(approve())
+	var realm string
+	h.OnAssertion = func(r, _ string) { realm = r }
+	checkid(t, h, map[string]string{"realm": ""})
+	if realm != testReturnTo {
+		t.Errorf("unexpected asserted realm %q, expected %q", realm, testReturnTo)
+	}
+}
+
+func TestOnSigned(t *testing.T) {
+	h := newTestHandler(approve(Extension{
+		Namespace: sreg11Namespace,
+		Params:    map[string]string{"email": "alice@example.com"},
+	}))
+	var calls int
+	var req *LoginRequest
+	var signed []string
+	h.OnSigned = func(r *LoginRequest, s []string) {
+		calls++
+		req, signed = r, s
+	}
+	p := checkid(t, h, map[string]string{
+		"ns.sreg":       sreg11Namespace,
+		"sreg.required": "email",
+	})
+	if calls != 1 {
+		t.Fatalf("OnSigned called %d times, expected 1", calls)
+	}
+	if req.ReturnTo != testReturnTo {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if strings.Join(signed, ",") != p["signed"] {
+		t.Errorf("OnSigned called with %q, response signed %q", signed, p["signed"])
+	}
+	alias, _ := extensionParams(p, sreg11Namespace)
+	expect := []string{"op_endpoint", "return_to", "response_nonce", "assoc_handle", "claimed_id", "identity", alias + ".email"}
+	if !reflect.DeepEqual(signed, expect) {
+		t.Errorf("unexpected signed fields %q, expected %q", signed, expect)
+	}
+}
+
+func TestBuildUnsolicitedAssertion(t *testing.T) {
+	h := newTestHandler(nil)
+	loc, err := h.BuildUnsolicitedAssertion(testReturnTo, testID, testID, []Extension{{
+		Namespace: sreg11Namespace,
+		Prefix:    "sreg",
+		Params:    map[string]string{"nickname": "alice"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != "1" {
+		t.Errorf("return_to parameters not preserved in %q", loc)
+	}
+	p := ParseHTTP(u.Query())
+	if p["mode"] != "id_res" || p["return_to"] != testReturnTo || p["claimed_id"] != testID || p["op_endpoint"] != testEndpoint || p["sreg.nickname"] != "alice" {
+		t.Errorf("unexpected assertion %v", p)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+	}
+
+	h.OPEndpoint = ""
+	if _, err := h.BuildUnsolicitedAssertion(testReturnTo, testID, testID, nil); err == nil || err.Error() != "cannot build unsolicited assertion: OP endpoint not known" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestBuildUnsolicitedAssertionHooks(t *testing.T) {
+	h := newTestHandler(nil)
+	var realm, claimedID string
+	h.OnAssertion = func(r, id string) {
+		realm, claimedID = r, id
+	}
+	var req *LoginRequest
+	var signed []string
+	h.OnSigned = func(r *LoginRequest, s []string) {
+		req, signed = r, s
+	}
+	loc, err := h.BuildUnsolicitedAssertion(testReturnTo, testID, testID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realm != testReturnTo || claimedID != testID {
+		t.Errorf("unexpected OnAssertion call with %q, %q", realm, claimedID)
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ParseHTTP(u.Query())
+	if req == nil || req.ReturnTo != testReturnTo || strings.Join(signed, ",") != p["signed"] {
+		t.Errorf("unexpected OnSigned call with %+v, %q, expected signed %q", req, signed, p["signed"])
+	}
+}
+
+func TestOPEndpointValidation(t *testing.T) {
+	tests := []struct {
+		endpoint     string
+		requireHTTPS bool
+		err          string
+	}{{
+		endpoint: "https://op.example.com/openid",
+	}, {
+		endpoint:     "https://op.example.com/openid",
+		requireHTTPS: true,
+	}, {
+		endpoint: "http://op.example.com/openid",
+	}, {
+		endpoint:     "http://op.example.com/openid",
+		requireHTTPS: true,
+		err:          `invalid op_endpoint "http://op.example.com/openid": must be an https URL`,
+	}, {
+		endpoint: "/openid",
+		err:      `invalid op_endpoint "/openid": must be an absolute URL`,
+	}, {
+		endpoint:     "/openid",
+		requireHTTPS: true,
+		err:          `invalid op_endpoint "/openid": must be an absolute URL`,
+	}}
+	for _, test := range tests {
+		h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+			return &LoginResponse{ClaimedID: testID, Identity: testID, OPEndpoint: test.endpoint}, nil
+		}))
+		h.RequireHTTPS = test.requireHTTPS
+		h.TrustedReturnTo = func(string) bool { return true }
+		p := checkid(t, h, nil)
+		if test.err == "" {
+			if p["mode"] != "id_res" || p["op_endpoint"] != test.endpoint {
+				t.Errorf("%q (https %v): unexpected response %v", test.endpoint, test.requireHTTPS, p)
+			}
+			continue
+		}
+		if p["mode"] != "error" || p["error"] != test.err {
+			t.Errorf("%q (https %v): unexpected response %v, expected error %q", test.endpoint, test.requireHTTPS, p, test.err)
+		}
+	}
+}
+
+func TestAssociationExpiresDuringLogin(t *testing.T) {
+	now := time.Now()
+	var advance time.Duration
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		// The user takes a long time to log in.
+		now = now.Add(advance)
+		return &LoginResponse{ClaimedID: testID, Identity: testID}, nil
+	}))
+	h.now = func() time.Time { return now }
+	handle := checkid(t, h, nil)["assoc_handle"]
+
+	advance = 2 * time.Minute
+	p := checkid(t, h, map[string]string{"assoc_handle": handle})
+	if p["assoc_handle"] == handle {
+		t.Errorf("expired association %q used", handle)
+	}
+	if p["invalidate_handle"] != handle {
+		t.Errorf("unexpected invalidate_handle %q, expected %q", p["invalidate_handle"], handle)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+	}
+}
+
+func TestExpiryMargin(t *testing.T) {
+	tests := []struct {
+		about   string
+		margin  time.Duration
+		advance time.Duration
+		reuse   bool
+	}{{
+		about:   "outside default margin",
+		advance: 50 * time.Second,
+		reuse:   true,
+	}, {
+		about:   "inside default margin",
+		advance: 57 * time.Second,
+	}, {
+		about:   "inside configured margin",
+		margin:  20 * time.Second,
+		advance: 45 * time.Second,
+	}, {
+		about:   "no margin",
+		margin:  -1,
+		advance: 59 * time.Second,
+		reuse:   true,
+	}}
+	for _, test := range tests {
+		now := time.Now()
+		h := newTestHandler(approve())
+		h.ExpiryMargin = test.margin
+		h.now = func() time.Time { return now }
+		handle := checkid(t, h, nil)["assoc_handle"]
+
+		now = now.Add(test.advance)
+		p := checkid(t, h, map[string]string{"assoc_handle": handle})
+		if reused := p["assoc_handle"] == handle; reused != test.reuse {
+			t.Errorf("%s: association reused %v, expected %v", test.about, reused, test.reuse)
+		}
+		if v := verify(t, h, p); v != "true" {
+			t.Errorf("%s: unexpected is_valid %q, expected %q", test.about, v, "true")
+		}
+	}
+}
+
+func TestAssociationFor(t *testing.T) {
+	h := newTestHandler(approve())
+	h.HandlePrefix = "op-"
+	custom := testAssociation(testEndpoint, "op-custom", time.Hour)
+	if err := h.Associations.Add(custom); err != nil {
+		t.Fatal(err)
+	}
+	var got *LoginRequest
+	h.AssociationFor = func(req *LoginRequest) (*Association, error) {
+		got = req
+		return custom, nil
+	}
+	p := checkid(t, h, nil)
+	if p["mode"] != "id_res" || p["assoc_handle"] != "op-custom" {
+		t.Fatalf("unexpected response %v", p)
+	}
+	if got == nil || got.ReturnTo != testReturnTo {
+		t.Errorf("unexpected request passed to AssociationFor %+v", got)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+	}
+}
+
+func TestAssociationForInvalidateHandle(t *testing.T) {
+	h := newTestHandler(approve())
+	h.HandlePrefix = "op-"
+	valid := checkid(t, h, nil)["assoc_handle"]
+	custom := testAssociation(testEndpoint, "op-custom", time.Hour)
+	if err := h.Associations.Add(custom); err != nil {
+		t.Fatal(err)
+	}
+	h.AssociationFor = func(*LoginRequest) (*Association, error) {
+		return custom, nil
+	}
+	p := checkid(t, h, map[string]string{"assoc_handle": valid})
+	if p["assoc_handle"] != "op-custom" {
+		t.Fatalf("unexpected response %v", p)
+	}
+	if v, ok := p["invalidate_handle"]; ok {
+		t.Errorf("valid handle invalidated: invalidate_handle %q", v)
+	}
+	p = checkid(t, h, map[string]string{"assoc_handle": "op-unknown"})
+	if p["invalidate_handle"] != "op-unknown" {
+		t.Errorf("unexpected invalidate_handle %q, expected %q", p["invalidate_handle"], "op-unknown")
+	}
+}
+
+func TestAssociationForReplaced(t *testing.T) {
+	tests := []struct {
+		about string
+		assoc *Association
+	}{{
+		about: "nil",
+	}, {
+		about: "expired",
+		assoc: testAssociation(testEndpoint, "op-expired", -time.Minute),
+	}, {
+		about: "expiring",
+		assoc: testAssociation(testEndpoint, "op-expiring", time.Second),
+	}}
+	for _, test := range tests {
+		h := newTestHandler(approve())
+		h.HandlePrefix = "op-"
+		h.AssociationFor = func(*LoginRequest) (*Association, error) {
+			return test.assoc, nil
+		}
+		p := checkid(t, h, nil)
+		if p["mode"] != "id_res" || !strings.HasPrefix(p["assoc_handle"], "op-") {
+			t.Errorf("%s: unexpected response %v", test.about, p)
+			continue
+		}
+		if test.assoc != nil && p["assoc_handle"] == test.assoc.Handle {
+			t.Errorf("%s: association %q used", test.about, test.assoc.Handle)
+		}
+		if v := verify(t, h, p); v != "true" {
+			t.Errorf("%s: unexpected is_valid %q, expected %q", test.about, v, "true")
+		}
+	}
+}
+
+func TestAssociationForRejected(t *testing.T) {
+	tests := []struct {
+		about string
+		assoc *Association
+		err   string
+	}{{
+		about: "unsupported type",
+		assoc: &Association{
+			Endpoint: testEndpoint,
+			Handle:   "op-h1",
+			Secret:   []byte("secret"),
+			Type:     "HMAC-MD5",
+			Expires:  time.Now().Add(time.Hour),
+		},
+		err: `cannot use association "op-h1": unsupported association type "HMAC-MD5"`,
+	}, {
+		about: "no secret",
+		assoc: &Association{
+			Endpoint: testEndpoint,
+			Handle:   "op-h1",
+			Type:     hmacSHA256,
+			Expires:  time.Now().Add(time.Hour),
+		},
+		err: `cannot use association "op-h1": no secret or signer`,
+	}, {
+		about: "no handle",
+		assoc: testAssociation(testEndpoint, "", time.Hour),
+		err:   `cannot use association "": handle does not start with "op-"`,
+	}, {
+		about: "wrong prefix",
+		assoc: testAssociation(testEndpoint, "other-h1", time.Hour),
+		err:   `cannot use association "other-h1": handle does not start with "op-"`,
+	}, {
+		about: "wrong endpoint",
+		assoc: testAssociation("https://other.example.com/openid", "op-h1", time.Hour),
+		err:   `cannot use association "op-h1": issued for OP endpoint "https://other.example.com/openid"`,
+	}}
+	for _, test := range tests {
+		h := newTestHandler(approve())
+		h.HandlePrefix = "op-"
+		h.TrustedReturnTo = func(string) bool { return true }
+		h.AssociationFor = func(*LoginRequest) (*Association, error) {
+			return test.assoc, nil
+		}
+		p := checkid(t, h, nil)
+		if p["mode"] != "error" || p["error"] != test.err {
+			t.Errorf("%s: unexpected response %v, expected error %q", test.about, p, test.err)
+		}
+	}
+}
+
+func TestApprovedExtensionsNothingApproved(t *testing.T) {
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		return &LoginResponse{
+			ClaimedID: testID,
+			Identity:  testID,
+			Extensions: []Extension{{
+				Namespace: sreg11Namespace,
+				Params: map[string]string{
+					"nickname": "alice",
+				},
+			}},
+			Approved: map[string][]string{},
+		}, nil
+	}))
+	p := checkid(t, h, map[string]string{
+		"ns.sreg":       sreg11Namespace,
+		"sreg.optional": "nickname",
+	})
+	alias, sreg := extensionParams(p, sreg11Namespace)
+	if alias == "" {
+		t.Fatalf("simple registration response omitted: %v", p)
+	}
+	if len(sreg) != 0 {
+		t.Errorf("unapproved fields returned: %v", sreg)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("assertion not verified: is_valid %q", v)
+	}
+}
+
+func TestApprovedAXAttributes(t *testing.T) {
+	h := newTestHandler(loginFunc(func(w http.ResponseWriter, r *http.Request, req *LoginRequest) (*LoginResponse, error) {
+		return &LoginResponse{
+			ClaimedID: testID,
+			Identity:  testID,
+			Extensions: []Extension{{
+				Namespace: axNamespace,
+				Prefix:    "ax",
+				Params: map[string]string{
+					"mode":          "fetch_response",
+					"type.email":    "http://axschema.org/contact/email",
+					"count.email":   "2",
+					"value.email.1": "alice@example.com",
+					"value.email.2": "alice@example.org",
+					"type.name":     "http://axschema.org/namePerson",
+					"value.name":    "Alice",
+				},
+			}},
+			Approved: map[string][]string{
+				axNamespace: {"email"},
+			},
+		}, nil
+	}))
+	p := checkid(t, h, map[string]string{
+		"ns.ax":          axNamespace,
+		"ax.mode":        "fetch_request",
+		"ax.type.email":  "http://axschema.org/contact/email",
+		"ax.count.email": "unlimited",
+		"ax.type.name":   "http://axschema.org/namePerson",
+		"ax.required":    "email,name",
+	})
+	alias, ax := extensionParams(p, axNamespace)
+	expect := map[string]string{
+		"mode":          "fetch_response",
+		"type.email":    "http://axschema.org/contact/email",
+		"count.email":   "2",
+		"value.email.1": "alice@example.com",
+		"value.email.2": "alice@example.org",
+	}
+	if !reflect.DeepEqual(ax, expect) {
+		t.Errorf("unexpected attribute exchange response %v, expected %v", ax, expect)
+	}
+	signed := make(map[string]bool)
+	for _, k := range strings.Split(p["signed"], ",") {
+		signed[k] = true
+	}
+	for k := range expect {
+		if !signed[alias+"."+k] {
+			t.Errorf("%s not signed: %q", k, p["signed"])
+		}
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("assertion not verified: is_valid %q", v)
+	}
+}
@@ -0,0 +1,148 @@
+package openid2
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRUAssociationStore is an in memory implementation of
+// AssociationStore that holds at most a fixed number of associations.
+// When the store is full expired associations are removed first, and
+// only if none have expired is the least recently used association
+// evicted.
+//
+// Evicting an association that is still valid causes check_authentication
+// requests for assertions signed with it to fail, so max should be
+// larger than the number of associations expected to be live at once.
+// Retrieving an association with Get marks it as used, so associations
+// that are in use for signing are evicted last.
+type LRUAssociationStore struct {
+	mu  sync.Mutex
+	max int
+
+	// l holds the associations in order of use, the most recently
+	// used association is at the front.
+	l *list.List
+	m map[string]map[string]*list.Element
+}
+
+// NewLRUAssociationStore creates a new LRUAssociationStore holding at
+// most max associations. NewLRUAssociationStore panics if max is less
+// than 1.
+func NewLRUAssociationStore(max int) *LRUAssociationStore {
+	if max < 1 {
+		panic("openid2: NewLRUAssociationStore called with max less than 1")
+	}
+	return &LRUAssociationStore{
+		max: max,
+		l:   list.New(),
+		m:   make(map[string]map[string]*list.Element),
+	}
+}
+
+// Add implements AssociationStore.Add.
+func (s *LRUAssociationStore) Add(a *Association) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.m[a.Endpoint][a.Handle]; e != nil {
+		if e.Value.(*Association).Valid(time.Now()) {
+			return ErrDuplicateAssociation
+		}
+		s.remove(e)
+	}
+	if s.l.Len() >= s.max {
+		s.removeExpired(time.Now())
+	}
+	for s.l.Len() >= s.max {
+		s.remove(s.l.Back())
+	}
+	a1 := *a
+	m := s.m[a.Endpoint]
+	if m == nil {
+		m = make(map[string]*list.Element)
+		s.m[a.Endpoint] = m
+	}
+	m[a.Handle] = s.l.PushFront(&a1)
+	return nil
+}
+
+// Get implements AssociationStore.Get.
+func (s *LRUAssociationStore) Get(endpoint, handle string) (*Association, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.m[endpoint][handle]
+	if e == nil {
+		return nil, nil
+	}
+	a := *e.Value.(*Association)
+	if !a.Valid(time.Now()) {
+		return nil, nil
+	}
+	s.l.MoveToFront(e)
+	return &a, nil
+}
+
+// Find implements AssociationStore.Find.
+func (s *LRUAssociationStore) Find(endpoint string) ([]*Association, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var assocs []*Association
+	for _, e := range s.m[endpoint] {
+		a := *e.Value.(*Association)
+		assocs = append(assocs, &a)
+	}
+	return assocs, nil
+}
+
+// Delete implements AssociationStore.Delete.
+func (s *LRUAssociationStore) Delete(endpoint, handle string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.m[endpoint][handle]; e != nil {
+		s.remove(e)
+	}
+	return nil
+}
+
+// DeleteAll implements AssociationStore.DeleteAll.
+func (s *LRUAssociationStore) DeleteAll(endpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.m[endpoint] {
+		s.l.Remove(e)
+	}
+	delete(s.m, endpoint)
+	return nil
+}
+
+// DeleteExpired implements BatchDeleter.DeleteExpired.
+func (s *LRUAssociationStore) DeleteExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeExpired(now), nil
+}
+
+// remove removes the association held in e. s.mu must be held.
+func (s *LRUAssociationStore) remove(e *list.Element) {
+	a := s.l.Remove(e).(*Association)
+	delete(s.m[a.Endpoint], a.Handle)
+	if len(s.m[a.Endpoint]) == 0 {
+		delete(s.m, a.Endpoint)
+	}
+}
+
+// removeExpired removes all associations that are no longer valid at
+// the given time, and returns the number removed. s.mu must be held.
+func (s *LRUAssociationStore) removeExpired(now time.Time) int {
+	var n int
+	var next *list.Element
+	for e := s.l.Front(); e != nil; e = next {
+		next = e.Next()
+		if !e.Value.(*Association).Valid(now) {
+			s.remove(e)
+			n++
+		}
+	}
+	return n
+}
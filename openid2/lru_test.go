@@ -0,0 +1,61 @@
+package openid2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUAssociationStoreEviction(t *testing.T) {
+	s := NewLRUAssociationStore(2)
+	for _, h := range []string{"h1", "h2"} {
+		if err := s.Add(testAssociation("ep", h, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Using h1 makes h2 the least recently used.
+	if a, _ := s.Get("ep", "h1"); a == nil {
+		t.Fatal("h1 not found")
+	}
+	if err := s.Add(testAssociation("ep", "h3", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for h, present := range map[string]bool{"h1": true, "h2": false, "h3": true} {
+		if a, _ := s.Get("ep", h); (a != nil) != present {
+			t.Errorf("%s: unexpected presence %v, expected %v", h, a != nil, present)
+		}
+	}
+
+	// Expired associations are removed before valid ones are
+	// evicted.
+	s = NewLRUAssociationStore(2)
+	if err := s.Add(testAssociation("ep", "expired", -time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(testAssociation("ep", "h1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(testAssociation("ep", "h2", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"h1", "h2"} {
+		if a, _ := s.Get("ep", h); a == nil {
+			t.Errorf("valid association %s evicted", h)
+		}
+	}
+	if n := s.l.Len(); n != 2 {
+		t.Errorf("unexpected size %d, expected 2", n)
+	}
+}
+
+func TestNewLRUAssociationStoreInvalidMax(t *testing.T) {
+	for _, max := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewLRUAssociationStore(%d) did not panic", max)
+				}
+			}()
+			NewLRUAssociationStore(max)
+		}()
+	}
+}
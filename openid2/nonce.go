@@ -0,0 +1,100 @@
+package openid2
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNonceUsed is returned by a NonceStore when a nonce has already
+// been used.
+var ErrNonceUsed = errors.New("nonce already used")
+
+// NonceStore records the response nonces that have been used with each
+// OP endpoint. An OP uses a NonceStore to guarantee that it never
+// issues the same nonce twice, and a relying party uses one to reject
+// assertions with a nonce it has already seen. The OP and relying
+// party must each use their own NonceStore.
+type NonceStore interface {
+	// Use records that nonce has been used with the specified OP
+	// endpoint. If the nonce has already been used ErrNonceUsed is
+	// returned.
+	Use(endpoint, nonce string) error
+}
+
+// MemoryNonceStore is an in memory implementation of NonceStore. Nonces
+// are only remembered for a limited window, nonces with a timestamp
+// older than the window are rejected.
+type MemoryNonceStore struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	m         map[string]map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewMemoryNonceStore creates a new MemoryNonceStore that remembers
+// nonces for the given window.
+func NewMemoryNonceStore(window time.Duration) *MemoryNonceStore {
+	return &MemoryNonceStore{
+		window: window,
+		m:      make(map[string]map[string]time.Time),
+	}
+}
+
+// Use implements NonceStore.Use.
+func (s *MemoryNonceStore) Use(endpoint, nonce string) error {
+	return s.useAt(time.Now(), endpoint, nonce)
+}
+
+// useAt implements nonceClockUser.useAt. A Handler uses it to check
+// its nonces against its own clock.
+func (s *MemoryNonceStore) useAt(now time.Time, endpoint, nonce string) error {
+	t, _, err := parseNonceTime(nonce)
+	if err != nil {
+		return err
+	}
+	if now.Sub(t) > s.window {
+		return fmt.Errorf("nonce %q has expired", nonce)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastPrune) >= s.window {
+		s.prune(now)
+		s.lastPrune = now
+	}
+	m := s.m[endpoint]
+	if m == nil {
+		m = make(map[string]time.Time)
+		s.m[endpoint] = m
+	}
+	if _, ok := m[nonce]; ok {
+		return ErrNonceUsed
+	}
+	m[nonce] = t
+	return nil
+}
+
+// prune removes nonces that are older than the window. It is called at
+// most once per window, so that each call to Use does not have to
+// examine every nonce. s.mu must be held.
+func (s *MemoryNonceStore) prune(now time.Time) {
+	for ep, m := range s.m {
+		for nonce, t := range m {
+			if now.Sub(t) > s.window {
+				delete(m, nonce)
+			}
+		}
+		if len(m) == 0 {
+			delete(s.m, ep)
+		}
+	}
+}
+
+// nonceClockUser is implemented by a NonceStore that can check the
+// freshness of a nonce against a given current time, rather than the
+// system clock.
+type nonceClockUser interface {
+	useAt(now time.Time, endpoint, nonce string) error
+}
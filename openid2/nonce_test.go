@@ -0,0 +1,155 @@
+package openid2
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedGenerator is a Generator that always generates the same values.
+type fixedGenerator struct {
+	handle, nonce string
+}
+
+func (g fixedGenerator) Handle() (string, error) { return g.handle, nil }
+func (g fixedGenerator) Nonce() (string, error)  { return g.nonce, nil }
+
+func TestMemoryNonceStore(t *testing.T) {
+	s := NewMemoryNonceStore(time.Hour)
+	nonce := time.Now().UTC().Format(time.RFC3339) + "abc"
+	if err := s.Use(testEndpoint, nonce); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := s.Use(testEndpoint, nonce); err != ErrNonceUsed {
+		t.Errorf("unexpected error reusing nonce %v, expected %v", err, ErrNonceUsed)
+	}
+	if err := s.Use("https://other.example.com/", nonce); err != nil {
+		t.Errorf("nonce rejected for another endpoint: %s", err)
+	}
+	old := time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339) + "abc"
+	if err := s.Use(testEndpoint, old); err == nil {
+		t.Errorf("expired nonce accepted")
+	}
+	if err := s.Use(testEndpoint, "not a nonce"); err == nil {
+		t.Errorf("malformed nonce accepted")
+	}
+}
+
+func TestMemoryNonceStorePrune(t *testing.T) {
+	s := NewMemoryNonceStore(time.Minute)
+	start := time.Now().Truncate(time.Second)
+	count := func() int {
+		var n int
+		for _, m := range s.m {
+			n += len(m)
+		}
+		return n
+	}
+	use := func(now, issued time.Time, unique string) {
+		t.Helper()
+		if err := s.useAt(now, testEndpoint, issued.UTC().Format(time.RFC3339)+unique); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	use(start, start.Add(-50*time.Second), "a")
+	use(start.Add(20*time.Second), start.Add(20*time.Second), "b")
+	// The first nonce has expired, but the nonces are only pruned
+	// once per window.
+	if n := count(); n != 2 {
+		t.Errorf("unexpected nonce count %d, expected 2", n)
+	}
+	use(start.Add(time.Minute), start.Add(time.Minute), "c")
+	if n := count(); n != 2 {
+		t.Errorf("unexpected nonce count %d after pruning, expected 2", n)
+	}
+	if _, ok := s.m[testEndpoint][start.Add(-50*time.Second).UTC().Format(time.RFC3339)+"a"]; ok {
+		t.Error("expired nonce not pruned")
+	}
+}
+
+func TestMemoryNonceStoreHandlerClock(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := newTestHandler(approve())
+	h.Nonces = NewMemoryNonceStore(time.Hour)
+	h.now = func() time.Time { return now }
+	p := checkid(t, h, nil)
+	if p["mode"] != "id_res" {
+		t.Fatalf("unexpected response %v", p)
+	}
+	if expect := "2020-01-02T03:04:05Z"; !strings.HasPrefix(p["response_nonce"], expect) {
+		t.Errorf("unexpected response_nonce %q, expected timestamp %q", p["response_nonce"], expect)
+	}
+}
+
+func TestNonceStoreIssueAndVerify(t *testing.T) {
+	// The OP uses its NonceStore to ensure it never issues the same
+	// nonce twice.
+	now := time.Now()
+	h := newTestHandler(approve())
+	h.Nonces = NewMemoryNonceStore(time.Hour)
+	h.Generator = fixedGenerator{handle: "handle", nonce: "same"}
+	h.now = func() time.Time { return now }
+	p := checkid(t, h, nil)
+	if p["mode"] != "id_res" {
+		t.Fatalf("unexpected response %v", p)
+	}
+	rec := serve(h, "GET", map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+	})
+	if e := directParams(t, rec); e["mode"] != "error" || e["error"] != "cannot generate unique nonce" {
+		t.Errorf("repeated nonce issued: %v", e)
+	}
+
+	// The relying party uses its own NonceStore to reject replayed
+	// assertions.
+	rp := NewMemoryNonceStore(time.Hour)
+	if err := rp.Use(p["op_endpoint"], p["response_nonce"]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := rp.Use(p["op_endpoint"], p["response_nonce"]); err != ErrNonceUsed {
+		t.Errorf("replayed assertion accepted: %v", err)
+	}
+}
+
+func TestCustomGenerator(t *testing.T) {
+	now := time.Now()
+	h := newTestHandler(approve())
+	h.HandlePrefix = "op-"
+	h.Generator = fixedGenerator{handle: "custom-handle", nonce: "custom-nonce"}
+	h.now = func() time.Time { return now }
+	p := checkid(t, h, nil)
+	if p["assoc_handle"] != "op-custom-handle" {
+		t.Errorf("unexpected assoc_handle %q, expected %q", p["assoc_handle"], "op-custom-handle")
+	}
+	if expect := now.UTC().Format(time.RFC3339) + "custom-nonce"; p["response_nonce"] != expect {
+		t.Errorf("unexpected response_nonce %q, expected %q", p["response_nonce"], expect)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+	}
+}
+
+func TestCustomGeneratorInvalid(t *testing.T) {
+	tests := []struct {
+		gen fixedGenerator
+		err string
+	}{{
+		gen: fixedGenerator{handle: "bad handle", nonce: "nonce"},
+		err: `invalid generated handle "bad handle"`,
+	}, {
+		gen: fixedGenerator{handle: "handle", nonce: ""},
+		err: "invalid generated nonce: empty",
+	}}
+	for _, test := range tests {
+		h := newTestHandler(approve())
+		h.TrustedReturnTo = func(string) bool { return true }
+		h.Generator = test.gen
+		p := checkid(t, h, nil)
+		if p["mode"] != "error" || p["error"] != test.err {
+			t.Errorf("%+v: unexpected response %v, expected error %q", test.gen, p, test.err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Package openid2test provides utilities for testing implementations
+// of the openid 2.0 protocol.
+package openid2test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mhilton/openid/openid2"
+)
+
+// returnTo is the return_to URL used in indirect requests.
+const returnTo = "http://rp.example.com/return?state=1"
+
+// RunConformance runs a set of protocol conformance checks against h,
+// which must implement an openid 2.0 OP endpoint. As the checks cannot
+// authenticate a user, assertion checks are only performed if h
+// responds to a checkid request with a positive assertion. Similarly a
+// successful associate response is only checked if h supports the
+// no-encryption session type.
+func RunConformance(t *testing.T, h http.Handler) {
+	t.Run("UnknownMode", func(t *testing.T) {
+		rec := direct(h, map[string]string{
+			"ns":   openid2.Namespace,
+			"mode": "no-such-mode",
+		})
+		p := parseDirect(t, rec)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+		}
+		if p["mode"] != "error" {
+			t.Errorf("unexpected mode %q, expected %q", p["mode"], "error")
+		}
+		if p["error"] == "" {
+			t.Errorf("error response has no error message")
+		}
+	})
+	t.Run("UnknownNamespace", func(t *testing.T) {
+		rec := direct(h, map[string]string{
+			"ns":   "http://openid.net/signon/1.0",
+			"mode": "check_authentication",
+		})
+		p := parseDirect(t, rec)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+		}
+		if p["mode"] != "error" {
+			t.Errorf("unexpected mode %q, expected %q", p["mode"], "error")
+		}
+	})
+	t.Run("RelyingPartyModes", func(t *testing.T) {
+		for _, mode := range []string{"id_res", "cancel", "setup_needed", "error"} {
+			rec := get(h, map[string]string{
+				"ns":        openid2.Namespace,
+				"mode":      mode,
+				"return_to": returnTo,
+			})
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("mode %q: unexpected status %d, expected %d", mode, rec.Code, http.StatusBadRequest)
+				continue
+			}
+			if p := parseDirect(t, rec); p["mode"] != "error" {
+				t.Errorf("mode %q: unexpected mode %q, expected %q", mode, p["mode"], "error")
+			}
+		}
+	})
+	t.Run("Associate", func(t *testing.T) {
+		rec := direct(h, map[string]string{
+			"ns":           openid2.Namespace,
+			"mode":         "associate",
+			"assoc_type":   "HMAC-SHA256",
+			"session_type": "no-encryption",
+		})
+		p := parseDirect(t, rec)
+		if p["mode"] == "error" {
+			// An OP need not support every session type,
+			// but must say so correctly.
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+			}
+			if p["error-code"] != "unsupported-type" {
+				t.Errorf("unexpected error-code %q, expected %q", p["error-code"], "unsupported-type")
+			}
+			return
+		}
+		checkAssociateResponse(t, rec, p, "HMAC-SHA256", "no-encryption")
+	})
+	t.Run("AssociateMissingSessionType", func(t *testing.T) {
+		rec := direct(h, map[string]string{
+			"ns":         openid2.Namespace,
+			"mode":       "associate",
+			"assoc_type": "HMAC-SHA256",
+		})
+		p := parseDirect(t, rec)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+		}
+		if p["mode"] != "error" || p["error"] == "" {
+			t.Errorf("unexpected response %v, expected an error", p)
+		}
+	})
+	t.Run("AssociateUnsupportedSessionType", func(t *testing.T) {
+		rec := direct(h, map[string]string{
+			"ns":           openid2.Namespace,
+			"mode":         "associate",
+			"assoc_type":   "HMAC-SHA256",
+			"session_type": "no-such-session-type",
+		})
+		p := parseDirect(t, rec)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusBadRequest)
+		}
+		if p["error-code"] != "unsupported-type" {
+			t.Errorf("unexpected error-code %q, expected %q", p["error-code"], "unsupported-type")
+		}
+	})
+	t.Run("CheckAuthenticationUnknownHandle", func(t *testing.T) {
+		rec := direct(h, map[string]string{
+			"ns":             openid2.Namespace,
+			"mode":           "check_authentication",
+			"op_endpoint":    "https://op.example.com/",
+			"return_to":      returnTo,
+			"response_nonce": "2005-05-15T17:11:51ZUNIQUE",
+			"assoc_handle":   "no-such-handle",
+			"signed":         "op_endpoint,return_to,response_nonce,assoc_handle",
+			"sig":            "AAAA",
+		})
+		p := parseDirect(t, rec)
+		if rec.Code != http.StatusOK {
+			t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusOK)
+		}
+		if p["is_valid"] != "false" {
+			t.Errorf("unexpected is_valid %q, expected %q", p["is_valid"], "false")
+		}
+	})
+	t.Run("CheckIDImmediate", func(t *testing.T) {
+		p := indirect(t, h, map[string]string{
+			"ns":        openid2.Namespace,
+			"mode":      "checkid_immediate",
+			"return_to": returnTo,
+			"realm":     "http://rp.example.com/",
+		})
+		if p == nil {
+			return
+		}
+		switch p["mode"] {
+		case "setup_needed":
+		case "id_res":
+			checkAssertion(t, h, p)
+		default:
+			t.Errorf("unexpected mode %q, expected %q or %q", p["mode"], "setup_needed", "id_res")
+		}
+	})
+	t.Run("CheckIDSetup", func(t *testing.T) {
+		rec := get(h, map[string]string{
+			"ns":        openid2.Namespace,
+			"mode":      "checkid_setup",
+			"return_to": returnTo,
+			"realm":     "http://rp.example.com/",
+		})
+		if rec.Code != http.StatusFound && rec.Code != http.StatusSeeOther {
+			// The OP is interacting with the user.
+			if rec.Code != http.StatusOK {
+				t.Errorf("unexpected status %d", rec.Code)
+			}
+			return
+		}
+		u, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("invalid Location: %s", err)
+		}
+		if !strings.HasPrefix(u.String(), "http://rp.example.com/return?") {
+			// The OP is redirecting the user to its own
+			// login page.
+			return
+		}
+		p := openid2.ParseHTTP(u.Query())
+		switch p["mode"] {
+		case "cancel":
+		case "id_res":
+			checkAssertion(t, h, p)
+		default:
+			t.Errorf("unexpected mode %q, expected %q or %q", p["mode"], "cancel", "id_res")
+		}
+	})
+}
+
+// checkAssociateResponse checks that p is a valid successful associate
+// response for the requested association and session types.
+func checkAssociateResponse(t *testing.T, rec *httptest.ResponseRecorder, p map[string]string, assocType, sessionType string) {
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusOK)
+	}
+	if p["assoc_handle"] == "" {
+		t.Errorf("no assoc_handle in %v", p)
+	}
+	if p["assoc_type"] != assocType {
+		t.Errorf("unexpected assoc_type %q, expected %q", p["assoc_type"], assocType)
+	}
+	if p["session_type"] != sessionType {
+		t.Errorf("unexpected session_type %q, expected %q", p["session_type"], sessionType)
+	}
+	if n, err := strconv.Atoi(p["expires_in"]); err != nil || n <= 0 {
+		t.Errorf("invalid expires_in %q", p["expires_in"])
+	}
+	if sessionType == "no-encryption" {
+		key, err := base64.StdEncoding.DecodeString(p["mac_key"])
+		if err != nil || len(key) == 0 {
+			t.Errorf("invalid mac_key %q", p["mac_key"])
+		}
+	}
+}
+
+// checkAssertion checks that the positive assertion p is correctly
+// formed and can be verified with check_authentication.
+func checkAssertion(t *testing.T, h http.Handler, p map[string]string) {
+	if p["return_to"] != returnTo {
+		t.Errorf("unexpected return_to %q, expected %q", p["return_to"], returnTo)
+	}
+	signed := make(map[string]bool)
+	for _, k := range strings.Split(p["signed"], ",") {
+		signed[k] = true
+	}
+	for _, k := range []string{"op_endpoint", "return_to", "response_nonce", "assoc_handle"} {
+		if !signed[k] {
+			t.Errorf("%s not signed", k)
+		}
+	}
+	if t.Failed() {
+		return
+	}
+
+	tampered := make(map[string]string)
+	for k, v := range p {
+		tampered[k] = v
+	}
+	tampered["mode"] = "check_authentication"
+	tampered["return_to"] = returnTo + "&tampered=1"
+	tp := parseDirect(t, direct(h, tampered))
+	if tp["is_valid"] != "false" {
+		t.Errorf("tampered assertion: unexpected is_valid %q, expected %q", tp["is_valid"], "false")
+	}
+
+	valid := make(map[string]string)
+	for k, v := range p {
+		valid[k] = v
+	}
+	valid["mode"] = "check_authentication"
+	vp := parseDirect(t, direct(h, valid))
+	if vp["is_valid"] != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", vp["is_valid"], "true")
+	}
+}
+
+// direct makes a direct request to h with the given parameters.
+func direct(h http.Handler, params map[string]string) *httptest.ResponseRecorder {
+	v := make(url.Values)
+	openid2.EncodeHTTP(v, params)
+	req := httptest.NewRequest("POST", "https://op.example.com/", strings.NewReader(v.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// get makes an indirect request to h with the given parameters, as
+// sent by a user agent, and returns the response.
+func get(h http.Handler, params map[string]string) *httptest.ResponseRecorder {
+	v := make(url.Values)
+	openid2.EncodeHTTP(v, params)
+	req := httptest.NewRequest("GET", "https://op.example.com/?"+v.Encode(), nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// parseDirect parses the key-value form body of a direct response.
+func parseDirect(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	p, err := openid2.ParseKeyValue([]byte(strings.TrimSuffix(rec.Body.String(), "\n")))
+	if err != nil {
+		t.Fatalf("cannot parse direct response: %s", err)
+	}
+	return p
+}
+
+// indirect makes an indirect request to h with the given parameters
+// and returns the parameters of the redirect back to return_to. If h
+// does not redirect to return_to, an error is recorded and nil is
+// returned.
+func indirect(t *testing.T, h http.Handler, params map[string]string) map[string]string {
+	rec := get(h, params)
+	if rec.Code != http.StatusFound && rec.Code != http.StatusSeeOther {
+		t.Errorf("unexpected status %d, expected a redirect", rec.Code)
+		return nil
+	}
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Errorf("invalid Location: %s", err)
+		return nil
+	}
+	if !strings.HasPrefix(u.String(), "http://rp.example.com/return?") {
+		t.Errorf("unexpected redirect to %q", u)
+		return nil
+	}
+	q := u.Query()
+	if q.Get("state") != "1" {
+		t.Errorf("return_to parameters not preserved in %q", u)
+	}
+	p := openid2.ParseHTTP(q)
+	if p["ns"] != openid2.Namespace {
+		t.Errorf("unexpected ns %q, expected %q", p["ns"], openid2.Namespace)
+	}
+	return p
+}
@@ -0,0 +1,174 @@
+package openid2test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mhilton/openid/openid2"
+)
+
+// TestAssociationStore tests that the AssociationStore implementation
+// returned by newStore behaves as required by the AssociationStore
+// interface. newStore is called to create a new, empty, store for each
+// test.
+func TestAssociationStore(t *testing.T, newStore func() openid2.AssociationStore) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	newAssoc := func(endpoint, handle string) *openid2.Association {
+		return &openid2.Association{
+			Endpoint: endpoint,
+			Handle:   handle,
+			Secret:   []byte("secret-" + handle),
+			Type:     "HMAC-SHA256",
+			Expires:  expires,
+		}
+	}
+
+	t.Run("AddGet", func(t *testing.T) {
+		s := newStore()
+		if err := s.Add(newAssoc("ep", "h1")); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+		a, err := s.Get("ep", "h1")
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		checkAssociation(t, a, newAssoc("ep", "h1"))
+	})
+	t.Run("GetNotFound", func(t *testing.T) {
+		s := newStore()
+		if err := s.Add(newAssoc("ep", "h1")); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+		for _, k := range [][2]string{{"ep", "h2"}, {"other", "h1"}} {
+			a, err := s.Get(k[0], k[1])
+			if err != nil {
+				t.Fatalf("Get(%q, %q): %s", k[0], k[1], err)
+			}
+			if a != nil {
+				t.Errorf("Get(%q, %q): unexpected association %#v", k[0], k[1], a)
+			}
+		}
+	})
+	t.Run("AddDuplicate", func(t *testing.T) {
+		s := newStore()
+		if err := s.Add(newAssoc("ep", "h1")); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+		if err := s.Add(newAssoc("ep", "h1")); err != openid2.ErrDuplicateAssociation {
+			t.Errorf("unexpected error adding duplicate, got %v, expected %v", err, openid2.ErrDuplicateAssociation)
+		}
+		if err := s.Add(newAssoc("other", "h1")); err != nil {
+			t.Errorf("cannot add same handle for another endpoint: %s", err)
+		}
+	})
+	t.Run("Find", func(t *testing.T) {
+		s := newStore()
+		for _, a := range []*openid2.Association{newAssoc("ep", "h1"), newAssoc("ep", "h2"), newAssoc("other", "h3")} {
+			if err := s.Add(a); err != nil {
+				t.Fatalf("Add: %s", err)
+			}
+		}
+		assocs, err := s.Find("ep")
+		if err != nil {
+			t.Fatalf("Find: %s", err)
+		}
+		found := make(map[string]*openid2.Association)
+		for _, a := range assocs {
+			found[a.Handle] = a
+		}
+		if len(assocs) != 2 || found["h1"] == nil || found["h2"] == nil {
+			t.Fatalf("unexpected associations found %v, expected h1 and h2", handles(assocs))
+		}
+		checkAssociation(t, found["h1"], newAssoc("ep", "h1"))
+		checkAssociation(t, found["h2"], newAssoc("ep", "h2"))
+	})
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore()
+		for _, a := range []*openid2.Association{newAssoc("ep", "h1"), newAssoc("ep", "h2")} {
+			if err := s.Add(a); err != nil {
+				t.Fatalf("Add: %s", err)
+			}
+		}
+		if err := s.Delete("ep", "h1"); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if err := s.Delete("ep", "no-such-handle"); err != nil {
+			t.Errorf("Delete of missing association: %s", err)
+		}
+		checkHandles(t, s, "ep", "h2")
+	})
+	t.Run("DeleteAll", func(t *testing.T) {
+		s := newStore()
+		for _, a := range []*openid2.Association{newAssoc("ep", "h1"), newAssoc("ep", "h2"), newAssoc("other", "h3")} {
+			if err := s.Add(a); err != nil {
+				t.Fatalf("Add: %s", err)
+			}
+		}
+		if err := s.DeleteAll("ep"); err != nil {
+			t.Fatalf("DeleteAll: %s", err)
+		}
+		checkHandles(t, s, "ep")
+		checkHandles(t, s, "other", "h3")
+	})
+	t.Run("Expired", func(t *testing.T) {
+		s := newStore()
+		a := newAssoc("ep", "h1")
+		a.Expires = time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := s.Add(a); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+		got, err := s.Get("ep", "h1")
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		// Stores may remove expired associations, but must not
+		// return them with a modified expiry time.
+		if got != nil && !got.Expires.Equal(a.Expires) {
+			t.Errorf("unexpected expiry time %s, expected %s", got.Expires, a.Expires)
+		}
+		// Find must return expired associations so that they can
+		// be swept.
+		checkHandles(t, s, "ep", "h1")
+	})
+}
+
+// checkAssociation checks that the association a matches the expected
+// association.
+func checkAssociation(t *testing.T, a, expect *openid2.Association) {
+	if a == nil {
+		t.Errorf("association %q not found", expect.Handle)
+		return
+	}
+	if a.Endpoint != expect.Endpoint || a.Handle != expect.Handle || a.Type != expect.Type || !bytes.Equal(a.Secret, expect.Secret) || !a.Expires.Equal(expect.Expires) {
+		t.Errorf("unexpected association %#v, expected %#v", a, expect)
+	}
+}
+
+// checkHandles checks that the store holds exactly the given handles
+// for endpoint.
+func checkHandles(t *testing.T, s openid2.AssociationStore, endpoint string, expect ...string) {
+	assocs, err := s.Find(endpoint)
+	if err != nil {
+		t.Fatalf("Find: %s", err)
+	}
+	found := make(map[string]bool)
+	for _, a := range assocs {
+		found[a.Handle] = true
+	}
+	ok := len(assocs) == len(expect)
+	for _, h := range expect {
+		ok = ok && found[h]
+	}
+	if !ok {
+		t.Errorf("unexpected associations for %q %v, expected %v", endpoint, handles(assocs), expect)
+	}
+}
+
+func handles(assocs []*openid2.Association) []string {
+	hs := make([]string, len(assocs))
+	for i, a := range assocs {
+		hs[i] = a.Handle
+	}
+	return hs
+}
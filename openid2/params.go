@@ -0,0 +1,84 @@
+package openid2
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Params holds a set of openid parameters, without the "openid."
+// prefix, and provides typed access to their values.
+type Params map[string]string
+
+// Int returns the value of the parameter with the given key as an
+// integer. An error is returned if the parameter is missing or is not
+// a valid integer.
+func (p Params) Int(key string) (int, error) {
+	v, ok := p[key]
+	if !ok {
+		return 0, missingParamError(key)
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s parameter %q: not an integer", key, v)
+	}
+	return n, nil
+}
+
+// Bool returns the value of the parameter with the given key as a
+// boolean. Valid values are "true" and "false". An error is returned
+// if the parameter is missing or is not a valid boolean.
+func (p Params) Bool(key string) (bool, error) {
+	v, ok := p[key]
+	if !ok {
+		return false, missingParamError(key)
+	}
+	switch v {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s parameter %q: not a boolean", key, v)
+}
+
+// Time returns the value of the parameter with the given key as a
+// time. The value must be a timestamp in the UTC format used
+// throughout openid, for example "2005-05-15T17:11:51Z". An error is
+// returned if the parameter is missing or is not a valid timestamp;
+// use parseNonceTime to read the timestamp at the start of a
+// response_nonce.
+func (p Params) Time(key string) (time.Time, error) {
+	v, ok := p[key]
+	if !ok {
+		return time.Time{}, missingParamError(key)
+	}
+	t, rest, err := parseTimestamp(v)
+	if err != nil || rest != "" {
+		return time.Time{}, fmt.Errorf("invalid %s parameter %q: not a UTC timestamp", key, v)
+	}
+	return t, nil
+}
+
+// timestampLen is the length of an openid timestamp.
+const timestampLen = len("2006-01-02T15:04:05Z")
+
+// parseTimestamp splits v into the UTC timestamp at its start and the
+// remainder of the value.
+func parseTimestamp(v string) (time.Time, string, error) {
+	if len(v) < timestampLen || v[timestampLen-1] != 'Z' {
+		return time.Time{}, "", errors.New("does not start with a UTC timestamp")
+	}
+	t, err := time.Parse(time.RFC3339, v[:timestampLen])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return t, v[timestampLen:], nil
+}
+
+type missingParamError string
+
+func (e missingParamError) Error() string {
+	return fmt.Sprintf("missing %s parameter", string(e))
+}
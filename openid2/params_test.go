@@ -0,0 +1,88 @@
+package openid2
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testParams = Params{
+	"int":        "42",
+	"badint":     "4.2",
+	"true":       "true",
+	"false":      "false",
+	"badbool":    "yes",
+	"time":       "2005-05-15T17:11:51Z",
+	"nonce":      "2005-05-15T17:11:51ZUNIQUE",
+	"trailing":   "2005-05-15T17:11:51Zgarbage",
+	"offsettime": "2005-05-15T17:11:51+01:00",
+	"badtime":    "2005-05-15",
+}
+
+func TestParamsInt(t *testing.T) {
+	if n, err := testParams.Int("int"); n != 42 || err != nil {
+		t.Errorf("Int(%q) = %d, %v, expected 42", "int", n, err)
+	}
+	for key, msg := range map[string]string{
+		"badint":  `invalid badint parameter "4.2": not an integer`,
+		"missing": "missing missing parameter",
+	} {
+		if _, err := testParams.Int(key); err == nil || err.Error() != msg {
+			t.Errorf("Int(%q): unexpected error %v, expected %q", key, err, msg)
+		}
+	}
+}
+
+func TestParamsBool(t *testing.T) {
+	if b, err := testParams.Bool("true"); !b || err != nil {
+		t.Errorf("Bool(%q) = %v, %v, expected true", "true", b, err)
+	}
+	if b, err := testParams.Bool("false"); b || err != nil {
+		t.Errorf("Bool(%q) = %v, %v, expected false", "false", b, err)
+	}
+	for key, msg := range map[string]string{
+		"badbool": `invalid badbool parameter "yes": not a boolean`,
+		"missing": "missing missing parameter",
+	} {
+		if _, err := testParams.Bool(key); err == nil || err.Error() != msg {
+			t.Errorf("Bool(%q): unexpected error %v, expected %q", key, err, msg)
+		}
+	}
+}
+
+func TestParamsTime(t *testing.T) {
+	expect := time.Date(2005, 5, 15, 17, 11, 51, 0, time.UTC)
+	if tm, err := testParams.Time("time"); !tm.Equal(expect) || err != nil {
+		t.Errorf("Time(%q) = %s, %v, expected %s", "time", tm, err, expect)
+	}
+	for key, msg := range map[string]string{
+		"nonce":      `invalid nonce parameter "2005-05-15T17:11:51ZUNIQUE": not a UTC timestamp`,
+		"trailing":   `invalid trailing parameter "2005-05-15T17:11:51Zgarbage": not a UTC timestamp`,
+		"offsettime": `invalid offsettime parameter "2005-05-15T17:11:51+01:00": not a UTC timestamp`,
+		"badtime":    `invalid badtime parameter "2005-05-15": not a UTC timestamp`,
+		"int":        `invalid int parameter "42": not a UTC timestamp`,
+		"missing":    "missing missing parameter",
+	} {
+		if _, err := testParams.Time(key); err == nil || err.Error() != msg {
+			t.Errorf("Time(%q): unexpected error %v, expected %q", key, err, msg)
+		}
+	}
+}
+
+func TestCheckAuthenticationMalformedNonceTime(t *testing.T) {
+	h := newTestHandler(approve())
+	p := checkid(t, h, nil)
+	assoc, err := h.Associations.Get(testEndpoint, p["assoc_handle"])
+	if err != nil || assoc == nil {
+		t.Fatalf("cannot get association: %v", err)
+	}
+	// Re-sign the assertion so that only the nonce is invalid.
+	p["response_nonce"] = "yesterdayUNIQUE"
+	p, err = h.signResponse(assoc, p, strings.Split(p["signed"], ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := verify(t, h, p); v != "false" {
+		t.Errorf("unexpected is_valid %q for malformed response_nonce", v)
+	}
+}
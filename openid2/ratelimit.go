@@ -0,0 +1,92 @@
+package openid2
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which requests are processed.
+type RateLimiter interface {
+	// Allow reports whether a request from the client identified by
+	// key may be processed.
+	Allow(key string) bool
+}
+
+// MemoryRateLimiter is an in memory implementation of RateLimiter
+// that allows a fixed number of requests from each client in each
+// period.
+type MemoryRateLimiter struct {
+	limit  int
+	period time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+// NewMemoryRateLimiter creates a new MemoryRateLimiter that allows at
+// most limit requests from a client in each period.
+func NewMemoryRateLimiter(limit int, period time.Duration) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		limit:   limit,
+		period:  period,
+		clients: make(map[string]*rateWindow),
+	}
+}
+
+// Allow implements RateLimiter.Allow.
+func (l *MemoryRateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	w := l.clients[key]
+	if w == nil || now.Sub(w.start) >= l.period {
+		if w == nil && len(l.clients) >= 1024 {
+			l.prune(now)
+		}
+		w = &rateWindow{start: now}
+		l.clients[key] = w
+	}
+	if w.n >= l.limit {
+		return false
+	}
+	w.n++
+	return true
+}
+
+// prune removes all clients whose period has ended. l.mu must be held.
+func (l *MemoryRateLimiter) prune(now time.Time) {
+	for k, w := range l.clients {
+		if now.Sub(w.start) >= l.period {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// clientKey returns the key identifying the client that made r.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// errThrottled is returned when a request is rejected by a
+// RateLimiter.
+var errThrottled = throttledError{errors.New("too many requests")}
+
+type throttledError struct {
+	error
+}
+
+func (throttledError) httpStatus() int {
+	return http.StatusTooManyRequests
+}
@@ -0,0 +1,49 @@
+package openid2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckAuthenticationRateLimit(t *testing.T) {
+	h := newTestHandler(approve())
+	h.CheckAuthenticationLimiter = NewMemoryRateLimiter(2, time.Hour)
+	v := make(url.Values)
+	EncodeHTTP(v, map[string]string{
+		"ns":   Namespace,
+		"mode": "check_authentication",
+	})
+	request := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", testEndpoint, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := request("192.0.2.1:1234"); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d throttled", i)
+		}
+	}
+	rec := request("192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("unexpected status %d, expected %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if p := directParams(t, rec); p["mode"] != "error" || p["error"] != "too many requests" {
+		t.Errorf("unexpected response %v", p)
+	}
+	if rec := request("192.0.2.2:1234"); rec.Code == http.StatusTooManyRequests {
+		t.Errorf("other client throttled")
+	}
+
+	// Other modes are not limited.
+	p := checkid(t, h, nil)
+	if p["mode"] != "id_res" {
+		t.Errorf("unexpected response %v", p)
+	}
+}
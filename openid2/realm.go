@@ -0,0 +1,105 @@
+package openid2
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ValidateRealm checks that realm is a well-formed realm. A realm must
+// be an absolute http or https URL without a fragment. The host may
+// start with a "*." wildcard, which matches any subdomain; no other
+// use of "*" is allowed.
+func ValidateRealm(realm string) error {
+	_, err := parseRealm(realm)
+	return err
+}
+
+// parseRealm parses and validates realm.
+func parseRealm(realm string) (*url.URL, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid realm %q: %s", realm, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid realm %q: must be an http or https URL", realm)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid realm %q: must be an absolute URL", realm)
+	}
+	if u.Fragment != "" || strings.Contains(realm, "#") {
+		return nil, fmt.Errorf("invalid realm %q: must not contain a fragment", realm)
+	}
+	host := strings.TrimPrefix(u.Hostname(), "*.")
+	if host == "" || strings.Contains(host, "*") {
+		return nil, fmt.Errorf("invalid realm %q: wildcard must be the first label of the host", realm)
+	}
+	return u, nil
+}
+
+// ValidateRealmReturnTo checks that returnTo falls within realm. The
+// scheme and port must be equal, the host must be equal or, for a
+// wildcard realm, a subdomain of the realm's host, and the path must be
+// equal to or below the realm's path.
+func ValidateRealmReturnTo(realm, returnTo string) error {
+	r, err := parseRealm(realm)
+	if err != nil {
+		return err
+	}
+	u, err := parseReturnTo(returnTo)
+	if err != nil {
+		return err
+	}
+	if r.Scheme != u.Scheme {
+		return fmt.Errorf("return_to %q does not match realm %q: scheme differs", returnTo, realm)
+	}
+	if urlPort(r) != urlPort(u) {
+		return fmt.Errorf("return_to %q does not match realm %q: port differs", returnTo, realm)
+	}
+	if !realmHostMatches(r.Hostname(), u.Hostname()) {
+		return fmt.Errorf("return_to %q does not match realm %q: host differs", returnTo, realm)
+	}
+	if !realmPathMatches(r.EscapedPath(), u.EscapedPath()) {
+		return fmt.Errorf("return_to %q does not match realm %q: path is not within the realm", returnTo, realm)
+	}
+	return nil
+}
+
+// urlPort returns the port of u, using the default port for the scheme
+// if none is given.
+func urlPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// realmHostMatches reports whether host is matched by the realm host
+// pattern, which may start with a "*." wildcard.
+func realmHostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[2:]
+		return host == pattern || strings.HasSuffix(host, "."+pattern)
+	}
+	return host == pattern
+}
+
+// realmPathMatches reports whether path is equal to or below the realm
+// path.
+func realmPathMatches(realmPath, path string) bool {
+	if realmPath == "" {
+		realmPath = "/"
+	}
+	if path == "" {
+		path = "/"
+	}
+	if path == realmPath || strings.HasSuffix(realmPath, "/") && strings.HasPrefix(path, realmPath) {
+		return true
+	}
+	return strings.HasPrefix(path, realmPath+"/")
+}
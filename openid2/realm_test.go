@@ -0,0 +1,148 @@
+package openid2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRealm(t *testing.T) {
+	tests := []struct {
+		realm string
+		err   string
+	}{{
+		realm: "https://rp.example.com/",
+	}, {
+		realm: "http://rp.example.com:8080/path/",
+	}, {
+		realm: "https://*.example.com/",
+	}, {
+		realm: "https://rp.example.com/#fragment",
+		err:   `invalid realm "https://rp.example.com/#fragment": must not contain a fragment`,
+	}, {
+		realm: "https://rp.example.com/#",
+		err:   `invalid realm "https://rp.example.com/#": must not contain a fragment`,
+	}, {
+		realm: "https://rp.*.com/",
+		err:   `invalid realm "https://rp.*.com/": wildcard must be the first label of the host`,
+	}, {
+		realm: "https://*/",
+		err:   `invalid realm "https://*/": wildcard must be the first label of the host`,
+	}, {
+		realm: "https://*rp.example.com/",
+		err:   `invalid realm "https://*rp.example.com/": wildcard must be the first label of the host`,
+	}, {
+		realm: "/relative/path",
+		err:   `invalid realm "/relative/path": must be an http or https URL`,
+	}, {
+		realm: "https:///path",
+		err:   `invalid realm "https:///path": must be an absolute URL`,
+	}, {
+		realm: "ftp://rp.example.com/",
+		err:   `invalid realm "ftp://rp.example.com/": must be an http or https URL`,
+	}}
+	for _, test := range tests {
+		err := ValidateRealm(test.realm)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("ValidateRealm(%q): unexpected error %s", test.realm, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("ValidateRealm(%q): unexpected error %v, expected %q", test.realm, err, test.err)
+		}
+	}
+}
+
+func TestValidateRealmReturnTo(t *testing.T) {
+	tests := []struct {
+		realm    string
+		returnTo string
+		err      string
+	}{{
+		realm:    "https://rp.example.com/",
+		returnTo: "https://rp.example.com/",
+	}, {
+		realm:    "https://rp.example.com/",
+		returnTo: "https://rp.example.com/login?x=1",
+	}, {
+		realm:    "https://rp.example.com",
+		returnTo: "https://rp.example.com/login",
+	}, {
+		realm:    "https://rp.example.com:443/",
+		returnTo: "https://rp.example.com/login",
+	}, {
+		realm:    "https://rp.example.com/app",
+		returnTo: "https://rp.example.com/app/login",
+	}, {
+		realm:    "https://rp.example.com/app/",
+		returnTo: "https://rp.example.com/app/login",
+	}, {
+		realm:    "https://*.example.com/",
+		returnTo: "https://www.rp.example.com/login",
+	}, {
+		realm:    "https://*.example.com/",
+		returnTo: "https://example.com/login",
+	}, {
+		realm:    "https://RP.example.com/",
+		returnTo: "https://rp.EXAMPLE.com/login",
+	}, {
+		realm:    "https://rp.example.com/",
+		returnTo: "http://rp.example.com/login",
+		err:      `return_to "http://rp.example.com/login" does not match realm "https://rp.example.com/": scheme differs`,
+	}, {
+		realm:    "https://rp.example.com/",
+		returnTo: "https://rp.example.com:8443/login",
+		err:      `return_to "https://rp.example.com:8443/login" does not match realm "https://rp.example.com/": port differs`,
+	}, {
+		realm:    "https://rp.example.com/",
+		returnTo: "https://evil.example.com/login",
+		err:      `return_to "https://evil.example.com/login" does not match realm "https://rp.example.com/": host differs`,
+	}, {
+		realm:    "https://*.example.com/",
+		returnTo: "https://rp.badexample.com/login",
+		err:      `return_to "https://rp.badexample.com/login" does not match realm "https://*.example.com/": host differs`,
+	}, {
+		realm:    "https://rp.example.com/app",
+		returnTo: "https://rp.example.com/application",
+		err:      `return_to "https://rp.example.com/application" does not match realm "https://rp.example.com/app": path is not within the realm`,
+	}, {
+		realm:    "https://rp.example.com/app/",
+		returnTo: "https://rp.example.com/other",
+		err:      `return_to "https://rp.example.com/other" does not match realm "https://rp.example.com/app/": path is not within the realm`,
+	}, {
+		realm:    "https://rp.example.com/#fragment",
+		returnTo: "https://rp.example.com/login",
+		err:      `invalid realm "https://rp.example.com/#fragment": must not contain a fragment`,
+	}, {
+		realm:    "https://rp.example.com/",
+		returnTo: "/login",
+		err:      `invalid return_to "/login": must be an http or https URL`,
+	}}
+	for _, test := range tests {
+		err := ValidateRealmReturnTo(test.realm, test.returnTo)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("ValidateRealmReturnTo(%q, %q): unexpected error %s", test.realm, test.returnTo, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("ValidateRealmReturnTo(%q, %q): unexpected error %v, expected %q", test.realm, test.returnTo, err, test.err)
+		}
+	}
+}
+
+func TestLoginRejectsMalformedRealm(t *testing.T) {
+	h := newTestHandler(approve())
+	rec := serve(h, "GET", map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     "https://rp.*.com/",
+	})
+	p := directParams(t, rec)
+	if p["mode"] != "error" || !strings.Contains(p["error"], "wildcard") {
+		t.Errorf("unexpected response %v", p)
+	}
+}
@@ -1,17 +1,198 @@
 package openid2
 
 import (
-	"crypto/rand"
-	"encoding/ascii85"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Handler struct {
 	Login        LoginHandler
 	Associations AssociationStore
+
+	// AssociationFor, if set, is called to choose the association
+	// used to sign the positive assertion for req. If it returns a
+	// nil association, or one that expires within ExpiryMargin, the
+	// handler chooses one as usual. The association's handle must
+	// start with HandlePrefix and, if its Endpoint is set, it must
+	// match the OP endpoint of the assertion. For the relying party
+	// to verify the assertion using check_authentication the
+	// association must be available from Associations.
+	AssociationFor func(req *LoginRequest) (*Association, error)
+
+	// NewAssociation, if set, is called to create each association
+	// the handler mints to sign assertions, in place of generating a
+	// secret in process. The association must have its Type and
+	// either its Secret or its Signer set, a Signer allows the key
+	// to be held in an HSM or KMS. The handler sets the Endpoint,
+	// Handle and Expires fields before saving the association in
+	// Associations, which must preserve the Signer for
+	// check_authentication to succeed. NewAssociation is not used if
+	// AssociationKey is set, and RealmKey is ignored if
+	// NewAssociation is set.
+	NewAssociation func(endpoint string) (*Association, error)
+
+	// Logger is used to log diagnostic messages. If Logger is nil
+	// the standard logger is used.
+	Logger *log.Logger
+
+	// Debug enables logging of the openid parameters of every
+	// request and response. Secret values are redacted.
+	Debug bool
+
+	// OnAssertion, if set, is called with the realm and claimed
+	// identifier of every positive assertion sent by the handler.
+	OnAssertion func(realm, claimedID string)
+
+	// OnSigned, if set, is called with the request and the list of
+	// signed fields of every positive assertion sent by the handler.
+	OnSigned func(req *LoginRequest, signed []string)
+
+	// BannedPrefixes holds extension namespace prefixes that are
+	// rejected in requests, in addition to those banned by the
+	// specification. An entry ending in "*" bans every prefix that
+	// starts with the rest of the entry.
+	BannedPrefixes []string
+
+	// SupportedExtensions optionally holds the namespaces of the
+	// extensions supported by the OP. Requests for any other
+	// extension are ignored. If SupportedExtensions is nil all
+	// extensions are passed to the LoginHandler.
+	SupportedExtensions []string
+
+	// CheckAuthenticationLimiter, if set, limits the rate of
+	// check_authentication requests from each client IP address.
+	CheckAuthenticationLimiter RateLimiter
+
+	// LenientSignedOrder causes positive assertions to be signed
+	// with the signed fields sorted into canonical order, and
+	// check_authentication to also accept signatures computed over
+	// the fields in that order, for relying parties that reorder the
+	// signed list. By default the fields must be in the order listed.
+	LenientSignedOrder bool
+
+	// LenientExtensions causes requests that declare the same
+	// extension namespace with more than one prefix to be accepted,
+	// with the parameters from each prefix merged. Where more than
+	// one prefix sets the same parameter the value from the lowest
+	// prefix is used. By default such requests are rejected.
+	LenientExtensions bool
+
+	// StrictNamespaces causes requests that declare an extension
+	// namespace that is not an absolute URI to be rejected.
+	StrictNamespaces bool
+
+	// RealmKey, if set, is a master key from which the secrets of
+	// associations used to sign assertions are derived. Each realm
+	// is given a distinct secret, so that assertions for one realm
+	// cannot be verified with the key used for another.
+	RealmKey []byte
+
+	// AssociationKey, if set, is a master key from which association
+	// secrets are derived using the association handle, which also
+	// records the association's expiry time. Any handler configured
+	// with the same AssociationKey can verify assertions without
+	// access to a shared AssociationStore, but such associations
+	// cannot be invalidated once used: an assertion can be verified
+	// repeatedly until its association expires. Handles with an
+	// expiry time beyond the lifetime of a new association are
+	// rejected. If AssociationKey is set, RealmKey is ignored.
+	AssociationKey []byte
+
+	// TrustedReturnTo, if set, reports whether error responses may
+	// be redirected to the given return_to URL. Error responses
+	// destined for any other return_to URL, or for any return_to
+	// URL if TrustedReturnTo is nil, are sent directly instead so
+	// that the handler cannot be used as an open redirector.
+	TrustedReturnTo func(returnTo string) bool
+
+	// SignatureLengths optionally holds the length, in bytes, that
+	// signatures made with each association type are truncated to.
+	// Association types that are not present produce full length
+	// signatures, as required by the specification. This should
+	// only be used to interoperate with non-conformant peers.
+	SignatureLengths map[string]int
+
+	// HandlePrefix is prepended to the handle of every association
+	// created by the handler. Associations whose handles do not
+	// start with HandlePrefix are ignored, which allows a single
+	// AssociationStore to be shared by several handlers.
+	HandlePrefix string
+
+	// HandleEncoding is used to encode the random bytes of newly
+	// generated association handles. The encoding must only produce
+	// characters that are safe in URLs and key-value form messages.
+	// If HandleEncoding is nil unpadded base64url encoding is used.
+	HandleEncoding func([]byte) string
+
+	// SignNamespace causes openid.ns to be included in the signed
+	// fields of positive assertions, for relying parties that
+	// expect it to be covered by the signature.
+	SignNamespace bool
+
+	// OPEndpoint is the URL of the OP endpoint served by the
+	// handler. It is used in positive assertions if the
+	// LoginResponse does not specify an OPEndpoint.
+	OPEndpoint string
+
+	// RequireHTTPS causes positive assertions to be rejected unless
+	// the OP endpoint is an https URL.
+	RequireHTTPS bool
+
+	// DetectOPEndpoint causes the OP endpoint to be determined from
+	// the first https request received for one of the
+	// OPEndpointHosts if OPEndpoint is not set. The detected endpoint
+	// is used for all subsequent requests. The query string of the
+	// request, which is chosen by the client, is not included; an
+	// endpoint with query parameters must be set in OPEndpoint.
+	DetectOPEndpoint bool
+
+	// OPEndpointHosts lists the hosts from which the OP endpoint may
+	// be detected when DetectOPEndpoint is set. The Host of a request
+	// is chosen by the client, so requests to any other host are
+	// rejected rather than being used to detect the endpoint.
+	OPEndpointHosts []string
+
+	// mu protects detectedEndpoint.
+	mu               sync.Mutex
+	detectedEndpoint string
+
+	// Nonces, if set, is used to ensure that each response nonce
+	// issued by the handler is unique. It must not be shared with a
+	// relying party.
+	Nonces NonceStore
+
+	// NonceLength is the number of random bytes included in each
+	// response nonce. If NonceLength is zero 16 bytes are used. It
+	// may be at most 176, so that the nonce does not exceed the
+	// maximum length allowed by the specification.
+	NonceLength int
+
+	// Generator is used to generate association handles and the
+	// unique part of response nonces. If Generator is nil random
+	// values are generated, as configured by HandleEncoding and
+	// NonceLength.
+	Generator Generator
+
+	// ExpiryMargin is the minimum time an existing association must
+	// have left before it expires to be reused to sign a response,
+	// allowing for clock skew and the time the relying party takes
+	// to verify the response. If ExpiryMargin is zero five seconds
+	// are used; if it is negative no margin is applied.
+	ExpiryMargin time.Duration
+
+	// now is used to get the current time. If it is nil time.Now is
+	// used.
+	now func() time.Time
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -23,96 +204,375 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "POST":
 		params = ParseHTTP(r.PostForm)
 	}
+	h.debugParams("request", params)
 	switch params["ns"] {
 	case Namespace:
 		break
 	default:
-		indirect(w, params["return_to"]).respond(nil, fmt.Errorf("unknown ns %q", params["ns"]))
+		h.indirect(w, r, params["return_to"]).respond(nil, fmt.Errorf("unknown ns %q", params["ns"]))
+		return
 	}
 	switch params["mode"] {
 	case "associate":
-		direct(w).respond(h.associate(params))
+		h.direct(w, r).respond(h.associate(params))
 	case "checkid_immediate", "checkid_setup":
 		h.login(w, r, params)
 	case "check_authentication":
-		direct(w).respond(h.checkAuthentication(params))
+		if h.CheckAuthenticationLimiter != nil && !h.CheckAuthenticationLimiter.Allow(clientKey(r)) {
+			h.direct(w, r).respond(nil, errThrottled)
+			return
+		}
+		h.direct(w, r).respond(h.checkAuthentication(r.Context(), params))
+	case "id_res", "cancel", "setup_needed", "error":
+		// These modes are only sent to relying parties, reject
+		// them directly so the response is never redirected.
+		h.direct(w, r).respond(nil, fmt.Errorf("mode %q is not accepted by an OP", params["mode"]))
 	default:
-		indirect(w, params["return_to"]).respond(nil, fmt.Errorf("unknown mode %q", params["mode"]))
+		h.indirect(w, r, params["return_to"]).respond(nil, fmt.Errorf("unknown mode %q", params["mode"]))
 	}
 	return
 }
 
-func (h *Handler) getNonce() (string, error) {
-	var nonce [16]byte
-	if _, err := rand.Read(nonce[:]); err != nil {
+// opEndpoint returns the OP endpoint URL to use in responses to r.
+func (h *Handler) opEndpoint(r *http.Request) (string, error) {
+	if h.OPEndpoint != "" || !h.DetectOPEndpoint {
+		return h.OPEndpoint, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.detectedEndpoint != "" {
+		return h.detectedEndpoint, nil
+	}
+	u := requestURL(r)
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("cannot detect OP endpoint from non-https request to %q", u)
+	}
+	if !h.isOPEndpointHost(u.Host) {
+		return "", fmt.Errorf("cannot detect OP endpoint from request to untrusted host %q", u.Host)
+	}
+	h.detectedEndpoint = u.String()
+	return h.detectedEndpoint, nil
+}
+
+// isOPEndpointHost reports whether host is one of the handler's
+// OPEndpointHosts.
+func (h *Handler) isOPEndpointHost(host string) bool {
+	for _, allowed := range h.OPEndpointHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clock returns the current time.
+func (h *Handler) clock() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+// requestURL returns the absolute URL of the endpoint that received r.
+func requestURL(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   r.Host,
+		Path:   r.URL.Path,
+	}
+}
+
+// isEndpoint reports whether returnTo refers to the endpoint that
+// received r. The scheme is ignored as it cannot be reliably
+// determined behind a proxy.
+func isEndpoint(r *http.Request, returnTo string) bool {
+	if returnTo == "" {
+		return false
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return false
+	}
+	ep := requestURL(r)
+	return strings.EqualFold(u.Host, ep.Host) && strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(ep.Path, "/")
+}
+
+func (h *Handler) extensionPolicy() extensionPolicy {
+	return extensionPolicy{
+		banned:           h.BannedPrefixes,
+		supported:        h.SupportedExtensions,
+		mergeDuplicates:  h.LenientExtensions,
+		strictNamespaces: h.StrictNamespaces,
+	}
+}
+
+// defaultNonceLength is the number of random bytes in a response nonce
+// if the handler's NonceLength is not set.
+const defaultNonceLength = 16
+
+// maxNonceLength is the largest number of random bytes that can be
+// included in a response nonce without exceeding the 255 character
+// limit imposed by the specification.
+const maxNonceLength = (255 - nonceTimeLen) * 3 / 4
+
+// getNonce generates a new response nonce for the OP endpoint. If the
+// handler has a NonceStore the nonce is recorded in it to guarantee
+// that it is unique.
+func (h *Handler) getNonce(ctx context.Context, endpoint string) (string, error) {
+	for i := 0; i < 10; i++ {
+		nonce, err := h.newNonce()
+		if err != nil {
+			return "", err
+		}
+		if h.Nonces == nil {
+			return nonce, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if s, ok := h.Nonces.(nonceClockUser); ok {
+			err = s.useAt(h.clock(), endpoint, nonce)
+		} else {
+			err = h.Nonces.Use(endpoint, nonce)
+		}
+		if err == nil {
+			return nonce, nil
+		}
+		if err != ErrNonceUsed {
+			return "", err
+		}
+	}
+	return "", errors.New("cannot generate unique nonce")
+}
+
+// newNonce generates a response nonce from the current time and a
+// value from the handler's Generator.
+func (h *Handler) newNonce() (string, error) {
+	unique, err := h.generator().Nonce()
+	if err != nil {
+		return "", err
+	}
+	if err := validGenerated("nonce", unique); err != nil {
 		return "", err
 	}
-	enonce := make([]byte, ascii85.MaxEncodedLen(len(nonce)))
-	n := ascii85.Encode(enonce, nonce[:])
-	return fmt.Sprintf("%s%s", time.Now().UTC().Format(time.RFC3339), enonce[:n]), nil
+	if nonceTimeLen+len(unique) > 255 {
+		return "", fmt.Errorf("invalid generated nonce %q: too long", unique)
+	}
+	return h.clock().UTC().Format(time.RFC3339) + unique, nil
+}
+
+// nonceTimeLen is the length of the timestamp at the start of a
+// response nonce.
+const nonceTimeLen = timestampLen
+
+// parseNonceTime splits a response_nonce into its timestamp and unique
+// suffix. An error is returned if the nonce does not start with a
+// valid UTC timestamp.
+func parseNonceTime(nonce string) (time.Time, string, error) {
+	t, unique, err := parseTimestamp(nonce)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid response_nonce %q: %s", nonce, err)
+	}
+	return t, unique, nil
 }
 
 type responder interface {
 	respond(map[string]string, error)
 }
 
-func direct(w http.ResponseWriter) responder {
-	return directResponder{w}
+func (h *Handler) direct(w http.ResponseWriter, r *http.Request) responder {
+	return directResponder{h, w, r}
 }
 
 type directResponder struct {
+	h *Handler
 	w http.ResponseWriter
+	r *http.Request
 }
 
 func (d directResponder) respond(params map[string]string, err error) {
+	noCache(d.w)
+	status := http.StatusOK
+	if params == nil && err == nil {
+		err = errors.New("malformed request")
+	}
 	if err != nil {
-		d.w.WriteHeader(http.StatusBadRequest)
+		status = http.StatusBadRequest
+		if err, ok := err.(httpStatuser); ok {
+			status = err.httpStatus()
+		}
 		params = makeError(err)
+		if acceptsJSON(d.r) {
+			d.h.debugParams("response", params)
+			d.w.Header().Set("Content-Type", "application/json")
+			d.w.WriteHeader(status)
+			json.NewEncoder(d.w).Encode(params)
+			return
+		}
 	}
+	d.h.debugParams("response", params)
+	d.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	d.w.WriteHeader(status)
 	EncodeKeyValue(d.w, params)
 }
 
-func indirect(w http.ResponseWriter, returnTo string) responder {
+func (h *Handler) indirect(w http.ResponseWriter, r *http.Request, returnTo string) responder {
 	if returnTo == "" {
-		return direct(w)
+		return h.direct(w, r)
 	}
-	u, err := url.Parse(returnTo)
+	u, err := parseReturnTo(returnTo)
 	if err != nil {
-		return direct(w)
+		return h.direct(w, r)
 	}
-	return &indirectResponder{w, u}
+	return &indirectResponder{h, w, r, u}
 }
 
 type indirectResponder struct {
+	h        *Handler
 	w        http.ResponseWriter
+	r        *http.Request
 	returnTo *url.URL
 }
 
 func (i *indirectResponder) respond(params map[string]string, err error) {
-	v := i.returnTo.Query()
 	if err != nil {
+		if i.h.TrustedReturnTo == nil || !i.h.TrustedReturnTo(i.returnTo.String()) {
+			i.h.direct(i.w, i.r).respond(nil, err)
+			return
+		}
 		params = makeError(err)
 	}
-	EncodeHTTP(v, params)
-	i.returnTo.RawQuery = v.Encode()
-	i.w.Header().Set("Location", i.returnTo.String())
+	i.h.debugParams("response", params)
+	noCache(i.w)
+	i.w.Header().Set("Location", redirectURL(i.returnTo, params))
 	i.w.WriteHeader(http.StatusSeeOther)
 }
 
+// redirectURL returns the URL that sends params to returnTo in an
+// indirect message.
+func redirectURL(returnTo *url.URL, params map[string]string) string {
+	// The original return_to parameters are preserved exactly, as
+	// the relying party will compare them with the return_to it
+	// sent.
+	v := make(url.Values)
+	EncodeHTTP(v, params)
+	q := stripRawQuery(returnTo.RawQuery)
+	if q != "" {
+		q += "&"
+	}
+	u := *returnTo
+	u.RawQuery = q + v.Encode()
+	return u.String()
+}
+
+// acceptsJSON reports whether the client that made r has asked for
+// JSON responses.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			if mt, _, err := mime.ParseMediaType(t); err == nil && mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// noCache sets headers preventing the response in w from being cached.
+func noCache(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+}
+
 func makeError(err error) map[string]string {
-	e := map[string]string{
-		"ns":    Namespace,
-		"mode":  "error",
-		"error": err.Error(),
+	e := make(map[string]string)
+	addErrorParams(e, err)
+	e["ns"] = Namespace
+	e["mode"] = "error"
+	e["error"] = err.Error()
+	return e
+}
+
+// addErrorParams adds the parameters provided by err, and any errors
+// it wraps, to e. Parameters from outer errors take precedence over
+// those from the errors they wrap.
+func addErrorParams(e map[string]string, err error) {
+	switch err := err.(type) {
+	case interface{ Unwrap() error }:
+		if werr := err.Unwrap(); werr != nil {
+			addErrorParams(e, werr)
+		}
+	case interface{ Unwrap() []error }:
+		for _, werr := range err.Unwrap() {
+			addErrorParams(e, werr)
+		}
 	}
 	if err, ok := err.(errorParamser); ok {
 		for k, v := range err.errorParams() {
 			e[k] = v
 		}
 	}
-	return e
+}
+
+type httpStatuser interface {
+	httpStatus() int
 }
 
 type errorParamser interface {
 	errorParams() map[string]string
 }
+
+// logf logs a message to the configured Logger.
+func (h *Handler) logf(format string, a ...interface{}) {
+	if h.Logger != nil {
+		h.Logger.Printf(format, a...)
+		return
+	}
+	log.Printf(format, a...)
+}
+
+// debugf logs a message if debugging is enabled.
+func (h *Handler) debugf(format string, a ...interface{}) {
+	if !h.Debug {
+		return
+	}
+	h.logf(format, a...)
+}
+
+// redactedParams holds the parameters whose values are never logged.
+var redactedParams = map[string]bool{
+	"sig":         true,
+	"mac_key":     true,
+	"enc_mac_key": true,
+}
+
+// debugParams logs params, with any secret values redacted, if
+// debugging is enabled.
+func (h *Handler) debugParams(kind string, params map[string]string) {
+	if !h.Debug {
+		return
+	}
+	h.debugf("openid %s: %s", kind, dumpParams(params))
+}
+
+// dumpParams formats params for logging, redacting secret values.
+func dumpParams(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		v := params[k]
+		if redactedParams[k] {
+			v = "<redacted>"
+		}
+		parts[i] = fmt.Sprintf("%s=%q", k, v)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,492 @@
+package openid2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEndpoint is the OP endpoint used in tests.
+const testEndpoint = "https://op.example.com/openid"
+
+// serve sends a request containing the given openid parameters to h
+// and returns the recorded response. GET requests carry the
+// parameters in the query string, POST requests in the body.
+func serve(h http.Handler, method string, params map[string]string) *httptest.ResponseRecorder {
+	v := make(url.Values)
+	EncodeHTTP(v, params)
+	var req *http.Request
+	if method == "GET" {
+		req = httptest.NewRequest("GET", testEndpoint+"?"+v.Encode(), nil)
+	} else {
+		req = httptest.NewRequest(method, testEndpoint, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// directParams parses the key-value form body of a direct response.
+func directParams(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	p, err := ParseKeyValue(bytes.TrimSuffix(rec.Body.Bytes(), []byte("\n")))
+	if err != nil {
+		t.Fatalf("cannot parse direct response %q: %s", rec.Body.String(), err)
+	}
+	return p
+}
+
+// redirectParams returns the openid parameters of the indirect
+// response recorded in rec.
+func redirectParams(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status %d, expected %d (body %q)", rec.Code, http.StatusSeeOther, rec.Body.String())
+	}
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid Location: %s", err)
+	}
+	return ParseHTTP(u.Query())
+}
+
+func TestDumpParamsRedactsSecrets(t *testing.T) {
+	dump := dumpParams(map[string]string{
+		"mode":        "id_res",
+		"sig":         "c2lnbmF0dXJl",
+		"mac_key":     "bWFjLWtleQ==",
+		"enc_mac_key": "ZW5jLW1hYy1rZXk=",
+	})
+	for _, secret := range []string{"c2lnbmF0dXJl", "bWFjLWtleQ==", "ZW5jLW1hYy1rZXk="} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("dump %q contains secret %q", dump, secret)
+		}
+	}
+	for _, s := range []string{`mode="id_res"`, `sig="<redacted>"`, `mac_key="<redacted>"`, `enc_mac_key="<redacted>"`} {
+		if !strings.Contains(dump, s) {
+			t.Errorf("dump %q does not contain %s", dump, s)
+		}
+	}
+}
+
+func TestDebugLogsParams(t *testing.T) {
+	var buf bytes.Buffer
+	h := &Handler{
+		Logger:       log.New(&buf, "", 0),
+		Associations: NewMemoryAssociationStore(),
+	}
+	serve(h, "POST", map[string]string{
+		"ns":   Namespace,
+		"mode": "check_authentication",
+		"sig":  "c2lnbmF0dXJl",
+	})
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log output with debugging disabled: %q", buf.String())
+	}
+
+	h.Debug = true
+	serve(h, "POST", map[string]string{
+		"ns":   Namespace,
+		"mode": "check_authentication",
+		"sig":  "c2lnbmF0dXJl",
+	})
+	out := buf.String()
+	if !strings.Contains(out, `openid request: `) || !strings.Contains(out, `openid response: `) {
+		t.Errorf("request and response not logged: %q", out)
+	}
+	if !strings.Contains(out, `mode="check_authentication"`) {
+		t.Errorf("request params not logged: %q", out)
+	}
+	if strings.Contains(out, "c2lnbmF0dXJl") {
+		t.Errorf("signature logged: %q", out)
+	}
+}
+
+func TestParseNonceTime(t *testing.T) {
+	tests := []struct {
+		nonce  string
+		time   time.Time
+		unique string
+		// err holds the expected prefix of the error message.
+		err string
+	}{{
+		nonce:  "2005-05-15T17:11:51ZUNIQUE",
+		time:   time.Date(2005, 5, 15, 17, 11, 51, 0, time.UTC),
+		unique: "UNIQUE",
+	}, {
+		nonce: "2005-05-15T17:11:51Z",
+		time:  time.Date(2005, 5, 15, 17, 11, 51, 0, time.UTC),
+	}, {
+		nonce: "",
+		err:   `invalid response_nonce "": does not start with a UTC timestamp`,
+	}, {
+		nonce: "2005-05-15T17:11:51+00:00UNIQUE",
+		err:   `invalid response_nonce "2005-05-15T17:11:51+00:00UNIQUE": does not start with a UTC timestamp`,
+	}, {
+		nonce: "2005-05-15 17:11:51ZUNIQUE",
+		err:   `invalid response_nonce "2005-05-15 17:11:51ZUNIQUE": parsing time `,
+	}, {
+		nonce: "2005-13-15T17:11:51ZUNIQUE",
+		err:   `invalid response_nonce "2005-13-15T17:11:51ZUNIQUE": parsing time `,
+	}}
+	for _, test := range tests {
+		tm, unique, err := parseNonceTime(test.nonce)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("parseNonceTime(%q): unexpected error %v, expected %q", test.nonce, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNonceTime(%q): unexpected error %s", test.nonce, err)
+			continue
+		}
+		if !tm.Equal(test.time) || unique != test.unique {
+			t.Errorf("parseNonceTime(%q) = %s, %q, expected %s, %q", test.nonce, tm, unique, test.time, test.unique)
+		}
+	}
+}
+
+func TestErrorRedirectRequiresTrustedReturnTo(t *testing.T) {
+	params := map[string]string{
+		"ns":        Namespace,
+		"mode":      "no-such-mode",
+		"return_to": "https://attacker.example.com/",
+	}
+	h := &Handler{Associations: NewMemoryAssociationStore()}
+	rec := serve(h, "GET", params)
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("Location") != "" {
+		t.Errorf("error sent to untrusted return_to: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if p := directParams(t, rec); p["mode"] != "error" {
+		t.Errorf("unexpected mode %q, expected %q", p["mode"], "error")
+	}
+
+	h.TrustedReturnTo = func(returnTo string) bool {
+		return strings.HasPrefix(returnTo, "https://rp.example.com/")
+	}
+	rec = serve(h, "GET", params)
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("Location") != "" {
+		t.Errorf("error sent to untrusted return_to: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	params["return_to"] = "https://rp.example.com/return"
+	p := redirectParams(t, serve(h, "GET", params))
+	if p["mode"] != "error" || p["error"] != `unknown mode "no-such-mode"` {
+		t.Errorf("unexpected error response %v", p)
+	}
+}
+
+// paramsError is an error that contributes the given parameters to
+// error responses.
+type paramsError struct {
+	err    error
+	params map[string]string
+}
+
+func (e paramsError) Error() string                  { return "params error" }
+func (e paramsError) Unwrap() error                  { return e.err }
+func (e paramsError) errorParams() map[string]string { return e.params }
+
+func TestMakeErrorParams(t *testing.T) {
+	inner := paramsError{params: map[string]string{
+		"error-code":   "unsupported-type",
+		"assoc_type":   "HMAC-SHA1",
+		"session_type": "no-encryption",
+	}}
+	outer := paramsError{
+		err:    fmt.Errorf("wrapped: %w", inner),
+		params: map[string]string{"assoc_type": "HMAC-SHA256"},
+	}
+	p := makeError(outer)
+	expect := map[string]string{
+		"ns":           Namespace,
+		"mode":         "error",
+		"error":        "params error",
+		"error-code":   "unsupported-type",
+		"assoc_type":   "HMAC-SHA256",
+		"session_type": "no-encryption",
+	}
+	if !reflect.DeepEqual(p, expect) {
+		t.Errorf("unexpected error params %v, expected %v", p, expect)
+	}
+
+	// Error parameters cannot override the protocol fields.
+	p = makeError(paramsError{params: map[string]string{"mode": "id_res", "ns": "x"}})
+	if p["mode"] != "error" || p["ns"] != Namespace {
+		t.Errorf("protocol fields overridden: %v", p)
+	}
+}
+
+func TestDetectOPEndpoint(t *testing.T) {
+	h := newTestHandler(approve())
+	h.OPEndpoint = ""
+	h.DetectOPEndpoint = true
+	h.OPEndpointHosts = []string{"op.example.com"}
+	params := map[string]string{
+		"ns":         Namespace,
+		"mode":       "checkid_setup",
+		"claimed_id": "http://specs.openid.net/auth/2.0/identifier_select",
+		"identity":   "http://specs.openid.net/auth/2.0/identifier_select",
+		"return_to":  testReturnTo,
+		"realm":      testRealm,
+	}
+	request := func(endpoint string) *httptest.ResponseRecorder {
+		v := make(url.Values)
+		EncodeHTTP(v, params)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", endpoint+"?"+v.Encode(), nil))
+		return rec
+	}
+
+	// A request with a forged Host must not set the endpoint.
+	rec := request("https://attacker.example.com/openid")
+	if p := directParams(t, rec); p["mode"] != "error" {
+		t.Errorf("unexpected response to forged host %v", p)
+	}
+	if h.detectedEndpoint != "" {
+		t.Fatalf("endpoint detected from forged host: %q", h.detectedEndpoint)
+	}
+
+	p := redirectParams(t, request("https://op.example.com/openid"))
+	if p["op_endpoint"] != "https://op.example.com/openid" {
+		t.Errorf("unexpected op_endpoint %q", p["op_endpoint"])
+	}
+	for _, endpoint := range []string{"https://OP.example.com/other", "https://attacker.example.com/openid"} {
+		p := redirectParams(t, request(endpoint))
+		if p["op_endpoint"] != "https://op.example.com/openid" {
+			t.Errorf("request to %s: detected op_endpoint not reused, got %q", endpoint, p["op_endpoint"])
+		}
+	}
+}
+
+func TestOPEndpointQuery(t *testing.T) {
+	const endpoint = "https://op.example.com/openid?tenant=a%20b&x=%2F"
+	h := newTestHandler(approve())
+	h.OPEndpoint = endpoint
+	p := checkid(t, h, nil)
+	if p["op_endpoint"] != endpoint {
+		t.Errorf("unexpected op_endpoint %q, expected %q", p["op_endpoint"], endpoint)
+	}
+	if v := verify(t, h, p); v != "true" {
+		t.Errorf("unexpected is_valid %q, expected %q", v, "true")
+	}
+
+	// The client chosen query is not part of a detected endpoint.
+	h = newTestHandler(approve())
+	h.OPEndpoint = ""
+	h.DetectOPEndpoint = true
+	h.OPEndpointHosts = []string{"op.example.com"}
+	v := make(url.Values)
+	EncodeHTTP(v, map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", testEndpoint+"?tenant=evil&"+v.Encode(), nil))
+	if p := redirectParams(t, rec); p["op_endpoint"] != testEndpoint {
+		t.Errorf("unexpected op_endpoint %q, expected %q", p["op_endpoint"], testEndpoint)
+	}
+}
+
+func TestNoCacheHeaders(t *testing.T) {
+	h := newTestHandler(approve())
+	h.TrustedReturnTo = func(string) bool { return true }
+	check := func(name string, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if v := rec.Header().Get("Cache-Control"); v != "no-store" {
+			t.Errorf("%s: unexpected Cache-Control %q", name, v)
+		}
+		if v := rec.Header().Get("Pragma"); v != "no-cache" {
+			t.Errorf("%s: unexpected Pragma %q", name, v)
+		}
+	}
+	params := map[string]string{
+		"ns":        Namespace,
+		"mode":      "checkid_setup",
+		"return_to": testReturnTo,
+		"realm":     testRealm,
+	}
+	check("id_res", serve(h, "GET", params))
+	params["mode"] = "no-such-mode"
+	check("indirect error", serve(h, "GET", params))
+	check("direct error", serve(h, "POST", map[string]string{
+		"ns":   Namespace,
+		"mode": "associate",
+	}))
+	check("check_authentication", serve(h, "POST", map[string]string{
+		"ns":   Namespace,
+		"mode": "check_authentication",
+	}))
+}
+
+func TestJSONErrors(t *testing.T) {
+	h := newTestHandler(approve())
+	v := make(url.Values)
+	EncodeHTTP(v, map[string]string{
+		"ns":   Namespace,
+		"mode": "associate",
+	})
+	request := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", testEndpoint, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := request("text/html, application/json;q=0.9")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+	var p map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("cannot parse JSON error %q: %s", rec.Body.String(), err)
+	}
+	if p["mode"] != "error" || p["ns"] != Namespace || p["error"] == "" {
+		t.Errorf("unexpected JSON error %v", p)
+	}
+
+	rec = request("")
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if p := directParams(t, rec); p["mode"] != "error" {
+		t.Errorf("unexpected error %v", p)
+	}
+}
+
+func TestNonceLength(t *testing.T) {
+	for _, n := range []int{0, 1, 16, maxNonceLength} {
+		h := &Handler{NonceLength: n}
+		expect := n
+		if n == 0 {
+			expect = defaultNonceLength
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			nonce, err := h.newNonce()
+			if err != nil {
+				t.Fatalf("length %d: %s", n, err)
+			}
+			if len(nonce) > 255 {
+				t.Errorf("length %d: nonce %q too long", n, nonce)
+			}
+			_, unique, err := parseNonceTime(nonce)
+			if err != nil {
+				t.Fatalf("length %d: %s", n, err)
+			}
+			b, err := base64.RawURLEncoding.DecodeString(unique)
+			if err != nil || len(b) != expect {
+				t.Errorf("length %d: unexpected unique part %q (%d bytes, %v)", n, unique, len(b), err)
+			}
+			// Very short nonces are only unique with a
+			// NonceStore.
+			if expect >= 8 && seen[unique] {
+				t.Errorf("length %d: repeated nonce %q", n, nonce)
+			}
+			seen[unique] = true
+		}
+	}
+	for _, n := range []int{-1, maxNonceLength + 1} {
+		h := &Handler{NonceLength: n}
+		if _, err := h.newNonce(); err == nil || err.Error() != fmt.Sprintf("invalid nonce length %d", n) {
+			t.Errorf("length %d: unexpected error %v", n, err)
+		}
+	}
+}
+
+func TestRelyingPartyModesRejected(t *testing.T) {
+	h := newTestHandler(approve())
+	h.TrustedReturnTo = func(string) bool { return true }
+	for _, mode := range []string{"id_res", "cancel", "setup_needed", "error"} {
+		rec := serve(h, "POST", map[string]string{
+			"ns":        Namespace,
+			"mode":      mode,
+			"return_to": "https://attacker.example.com/",
+		})
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("Location") != "" {
+			t.Errorf("mode %q: unexpected status %d, Location %q", mode, rec.Code, rec.Header().Get("Location"))
+		}
+		p := directParams(t, rec)
+		if p["mode"] != "error" || p["error"] != fmt.Sprintf("mode %q is not accepted by an OP", mode) {
+			t.Errorf("mode %q: unexpected response %v", mode, p)
+		}
+	}
+}
+
+// headerRecorder records the headers and status at the time the
+// response body is first written.
+type headerRecorder struct {
+	*httptest.ResponseRecorder
+	status      int
+	contentType string
+}
+
+func (r *headerRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.contentType = r.Header().Get("Content-Type")
+	}
+	r.ResponseRecorder.WriteHeader(status)
+}
+
+func (r *headerRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.ResponseRecorder.Write(b)
+}
+
+func TestDirectResponseHeadersBeforeBody(t *testing.T) {
+	h := newTestHandler(nil)
+	v := make(url.Values)
+	EncodeHTTP(v, map[string]string{
+		"ns":   Namespace,
+		"mode": "associate",
+	})
+	req := httptest.NewRequest("POST", testEndpoint, strings.NewReader(v.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := &headerRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(rec, req)
+	if rec.status != http.StatusBadRequest {
+		t.Errorf("unexpected status %d before body, expected %d", rec.status, http.StatusBadRequest)
+	}
+	if rec.contentType != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q before body", rec.contentType)
+	}
+}
+
+func TestDirectResponseContentType(t *testing.T) {
+	h := newTestHandler(approve())
+	p := checkid(t, h, nil)
+	p["mode"] = "check_authentication"
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"success": serve(h, "POST", p),
+		"error": serve(h, "POST", map[string]string{
+			"ns":   Namespace,
+			"mode": "associate",
+		}),
+	} {
+		if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("%s: unexpected Content-Type %q", name, ct)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package openid2_test
+
+import (
+	"testing"
+
+	"github.com/mhilton/openid/openid2"
+	"github.com/mhilton/openid/openid2/openid2test"
+)
+
+func TestMemoryAssociationStore(t *testing.T) {
+	openid2test.TestAssociationStore(t, func() openid2.AssociationStore {
+		return openid2.NewMemoryAssociationStore()
+	})
+}
+
+func TestLRUAssociationStore(t *testing.T) {
+	openid2test.TestAssociationStore(t, func() openid2.AssociationStore {
+		return openid2.NewLRUAssociationStore(100)
+	})
+}
+
+func TestTieredAssociationStore(t *testing.T) {
+	openid2test.TestAssociationStore(t, func() openid2.AssociationStore {
+		return openid2.NewTieredAssociationStore(openid2.NewMemoryAssociationStore())
+	})
+}
@@ -0,0 +1,193 @@
+package openid2
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultSecondarySize is the number of associations held by the
+// secondary store created by NewTieredAssociationStore.
+const defaultSecondarySize = 10000
+
+// TieredAssociationStore is an AssociationStore that stores
+// associations in both a primary store, which is typically shared
+// between servers, and a local secondary store. If the primary store
+// fails, associations are read from the secondary store so that
+// associations created locally remain available.
+//
+// The primary store is authoritative whenever it is available, so that
+// associations deleted by another server are not used again. The
+// exception is associations that could only be written to the
+// secondary store, which are read from the secondary store if they are
+// not found in the primary store.
+//
+// Both stores must be safe for concurrent use. DeleteExpired should be
+// called periodically, for example with SweepAssociations, to remove
+// expired associations from both stores.
+type TieredAssociationStore struct {
+	Primary   AssociationStore
+	Secondary AssociationStore
+
+	// mu protects local.
+	mu sync.Mutex
+
+	// local holds the expiry times of the associations that were
+	// added to the secondary store but not the primary store.
+	local map[tieredKey]time.Time
+}
+
+type tieredKey struct {
+	endpoint, handle string
+}
+
+// NewTieredAssociationStore creates a new TieredAssociationStore using
+// the given primary store and an in memory LRUAssociationStore as the
+// secondary store.
+func NewTieredAssociationStore(primary AssociationStore) *TieredAssociationStore {
+	return &TieredAssociationStore{
+		Primary:   primary,
+		Secondary: NewLRUAssociationStore(defaultSecondarySize),
+	}
+}
+
+// Add implements AssociationStore.Add. The association is added to the
+// secondary store even if the primary store fails.
+func (s *TieredAssociationStore) Add(a *Association) error {
+	if err := s.Secondary.Add(a); err != nil {
+		return err
+	}
+	err := s.Primary.Add(a)
+	if err == ErrDuplicateAssociation {
+		s.Secondary.Delete(a.Endpoint, a.Handle)
+		return err
+	}
+	if err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.local == nil {
+			s.local = make(map[tieredKey]time.Time)
+		}
+		s.local[tieredKey{a.Endpoint, a.Handle}] = a.Expires
+	}
+	return nil
+}
+
+// Get implements AssociationStore.Get.
+func (s *TieredAssociationStore) Get(endpoint, handle string) (*Association, error) {
+	a, err := s.Primary.Get(endpoint, handle)
+	if err != nil {
+		return s.Secondary.Get(endpoint, handle)
+	}
+	if a != nil || !s.isLocal(endpoint, handle) {
+		return a, nil
+	}
+	a, err = s.Secondary.Get(endpoint, handle)
+	if err == nil && a == nil {
+		// The association has been removed from the secondary
+		// store, it no longer needs to be tracked.
+		s.mu.Lock()
+		delete(s.local, tieredKey{endpoint, handle})
+		s.mu.Unlock()
+	}
+	return a, err
+}
+
+// Find implements AssociationStore.Find.
+func (s *TieredAssociationStore) Find(endpoint string) ([]*Association, error) {
+	assocs, err := s.Primary.Find(endpoint)
+	if err != nil {
+		return s.Secondary.Find(endpoint)
+	}
+	if !s.hasLocal(endpoint) {
+		return assocs, nil
+	}
+	local, err := s.Secondary.Find(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range local {
+		if s.isLocal(a.Endpoint, a.Handle) {
+			assocs = append(assocs, a)
+		}
+	}
+	return assocs, nil
+}
+
+// Delete implements AssociationStore.Delete.
+func (s *TieredAssociationStore) Delete(endpoint, handle string) error {
+	s.mu.Lock()
+	delete(s.local, tieredKey{endpoint, handle})
+	s.mu.Unlock()
+	err := s.Secondary.Delete(endpoint, handle)
+	if perr := s.Primary.Delete(endpoint, handle); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// DeleteAll implements AssociationStore.DeleteAll.
+func (s *TieredAssociationStore) DeleteAll(endpoint string) error {
+	s.mu.Lock()
+	for k := range s.local {
+		if k.endpoint == endpoint {
+			delete(s.local, k)
+		}
+	}
+	s.mu.Unlock()
+	err := s.Secondary.DeleteAll(endpoint)
+	if perr := s.Primary.DeleteAll(endpoint); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// DeleteExpired implements BatchDeleter.DeleteExpired. Each store is
+// swept if it implements BatchDeleter; a primary store that does not
+// must be swept separately. The number returned is the number removed
+// from the primary store plus the number of expired associations that
+// were only held in the secondary store.
+func (s *TieredAssociationStore) DeleteExpired(now time.Time) (int, error) {
+	var n int
+	s.mu.Lock()
+	for k, expires := range s.local {
+		if !(Association{Expires: expires}).Valid(now) {
+			delete(s.local, k)
+			n++
+		}
+	}
+	s.mu.Unlock()
+	var err error
+	if bd, ok := s.Secondary.(BatchDeleter); ok {
+		_, err = bd.DeleteExpired(now)
+	}
+	if bd, ok := s.Primary.(BatchDeleter); ok {
+		pn, perr := bd.DeleteExpired(now)
+		n += pn
+		if perr != nil {
+			return n, perr
+		}
+	}
+	return n, err
+}
+
+// isLocal reports whether the association with the given endpoint and
+// handle was only added to the secondary store.
+func (s *TieredAssociationStore) isLocal(endpoint, handle string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.local[tieredKey{endpoint, handle}]
+	return ok
+}
+
+// hasLocal reports whether any association for endpoint was only added
+// to the secondary store.
+func (s *TieredAssociationStore) hasLocal(endpoint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.local {
+		if k.endpoint == endpoint {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package openid2
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStore is an AssociationStore that fails while down is set.
+type flakyStore struct {
+	*MemoryAssociationStore
+	down bool
+}
+
+var errFlaky = errors.New("store down")
+
+func (s *flakyStore) Add(a *Association) error {
+	if s.down {
+		return errFlaky
+	}
+	return s.MemoryAssociationStore.Add(a)
+}
+
+func (s *flakyStore) Get(endpoint, handle string) (*Association, error) {
+	if s.down {
+		return nil, errFlaky
+	}
+	return s.MemoryAssociationStore.Get(endpoint, handle)
+}
+
+func (s *flakyStore) Find(endpoint string) ([]*Association, error) {
+	if s.down {
+		return nil, errFlaky
+	}
+	return s.MemoryAssociationStore.Find(endpoint)
+}
+
+func TestTieredAssociationStorePrimaryFailure(t *testing.T) {
+	primary := &flakyStore{MemoryAssociationStore: NewMemoryAssociationStore()}
+	s := NewTieredAssociationStore(primary)
+	if err := s.Add(testAssociation("ep", "shared", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down = true
+	if err := s.Add(testAssociation("ep", "local", time.Hour)); err != nil {
+		t.Fatalf("association not added while primary is down: %s", err)
+	}
+	for _, h := range []string{"shared", "local"} {
+		if a, err := s.Get("ep", h); err != nil || a == nil {
+			t.Errorf("%s not found while primary is down: %v, %v", h, a, err)
+		}
+	}
+
+	// Once the primary recovers, associations only written locally
+	// are still found, but the primary is authoritative for the
+	// others.
+	primary.down = false
+	primary.MemoryAssociationStore.Delete("ep", "shared")
+	if a, err := s.Get("ep", "local"); err != nil || a == nil {
+		t.Errorf("local association not found after primary recovered: %v, %v", a, err)
+	}
+	if a, err := s.Get("ep", "shared"); err != nil || a != nil {
+		t.Errorf("association deleted from primary found: %v, %v", a, err)
+	}
+	as, err := s.Find("ep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0].Handle != "local" {
+		t.Errorf("unexpected associations found %v", assocHandles(as))
+	}
+
+	if err := s.Delete("ep", "local"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Get("ep", "local"); a != nil {
+		t.Errorf("deleted association found")
+	}
+	if len(s.local) != 0 {
+		t.Errorf("deleted association still tracked: %v", s.local)
+	}
+}
+
+func TestTieredAssociationStoreDeleteExpired(t *testing.T) {
+	primary := &flakyStore{MemoryAssociationStore: NewMemoryAssociationStore()}
+	s := NewTieredAssociationStore(primary)
+	for _, a := range []*Association{
+		testAssociation("ep", "live", time.Hour),
+		testAssociation("ep", "expired", -time.Hour),
+	} {
+		if err := s.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary.down = true
+	if err := s.Add(testAssociation("ep", "expired-local", -time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	primary.down = false
+
+	n, err := SweepAssociations(s, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d associations removed, expected 2", n)
+	}
+	for name, store := range map[string]AssociationStore{"primary": s.Primary, "secondary": s.Secondary} {
+		as, err := store.Find("ep")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(as) != 1 || as[0].Handle != "live" {
+			t.Errorf("%s: unexpected associations %v", name, assocHandles(as))
+		}
+	}
+	if len(s.local) != 0 {
+		t.Errorf("expired association still tracked: %v", s.local)
+	}
+}
+
+func TestTieredAssociationStoreConcurrent(t *testing.T) {
+	s := NewTieredAssociationStore(NewLRUAssociationStore(100))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h := fmt.Sprintf("h%d-%d", i, j)
+				s.Add(testAssociation("ep", h, time.Hour))
+				s.Get("ep", h)
+				s.Delete("ep", h)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// assocHandles returns the handles of assocs.
+func assocHandles(assocs []*Association) []string {
+	hs := make([]string, len(assocs))
+	for i, a := range assocs {
+		hs[i] = a.Handle
+	}
+	return hs
+}